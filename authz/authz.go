@@ -0,0 +1,97 @@
+package authz
+
+import (
+	"chatroom-api/models"
+	"os"
+	"strings"
+)
+
+// Action is something a user does inside a room.
+type Action int
+
+const (
+	ReadRoom          Action = iota // room details, history, live events
+	PostMessage                     // write messages
+	ManageInvites                   // create, list and revoke invites (admin)
+	ModerateMessages                // edit / delete other members' messages, see edit history (moderator)
+	KickMember                      // remove members below your role (moderator)
+	UpdateRoom                      // change room settings (admin)
+	ManageRoles                     // promote / demote members below your role (admin)
+	TransferOwnership               // (owner)
+	DeleteRoom                      // (admin)
+)
+
+func (a Action) String() string {
+	switch a {
+	case ReadRoom:
+		return "read"
+	case PostMessage:
+		return "post"
+	case ManageInvites:
+		return "manage invites"
+	case ModerateMessages:
+		return "moderate messages"
+	case KickMember:
+		return "kick members"
+	case UpdateRoom:
+		return "update room"
+	case ManageRoles:
+		return "manage roles"
+	case TransferOwnership:
+		return "transfer ownership"
+	case DeleteRoom:
+		return "delete room"
+	}
+	return "unknown"
+}
+
+// IsAdmin checks ADMIN_USERS (comma separated usernames with admin rights).
+// Read on each call so values loaded from .env after package init are honored.
+func IsAdmin(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, u := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if strings.TrimSpace(u) == username {
+			return true
+		}
+	}
+	return false
+}
+
+func IsMember(room models.Chatroom, username string) bool {
+	for _, u := range room.Users {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Can decides whether username may perform action in room.
+// Public rooms are readable by every authenticated user, private rooms only by members.
+// Only members may post, everything else depends on the member's room role.
+// Server admins may also manage invites.
+// Direct messages have no settings, roles or invites: members only read and post.
+func Can(username string, room models.Chatroom, action Action) bool {
+	member := IsMember(room, username)
+	role := RoleOf(room, username)
+	if room.IsDM() {
+		return member && (action == ReadRoom || action == PostMessage)
+	}
+	switch action {
+	case ReadRoom:
+		return member || !room.IsPrivate
+	case PostMessage:
+		return member
+	case ManageInvites:
+		return role.AtLeast(RoleAdmin) || IsAdmin(username)
+	case ModerateMessages, KickMember:
+		return role.AtLeast(RoleModerator)
+	case UpdateRoom, DeleteRoom, ManageRoles:
+		return role.AtLeast(RoleAdmin)
+	case TransferOwnership:
+		return role == RoleOwner
+	}
+	return false
+}
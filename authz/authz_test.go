@@ -0,0 +1,107 @@
+package authz
+
+import (
+	"chatroom-api/models"
+	"testing"
+)
+
+func testRoom() models.Chatroom {
+	return models.Chatroom{
+		RoomID:    "r1",
+		CreatedBy: "olga",
+		IsPrivate: true,
+		Users:     []string{"olga", "adam", "mona", "mike"},
+		Roles:     map[string]string{"olga": "owner", "adam": "admin", "mona": "moderator"},
+	}
+}
+
+func TestRoleOf(t *testing.T) {
+	room := testRoom()
+	want := map[string]Role{"olga": RoleOwner, "adam": RoleAdmin, "mona": RoleModerator, "mike": RoleMember, "eve": ""}
+	for user, role := range want {
+		if got := RoleOf(room, user); got != role {
+			t.Errorf("RoleOf(%s) = %q, want %q", user, got, role)
+		}
+	}
+	// only the caller's membership is loaded: a creator without a role is a plain member
+	partial := models.Chatroom{CreatedBy: "olga", Users: []string{"olga"}}
+	if got := RoleOf(partial, "olga"); got != RoleMember {
+		t.Errorf("creator without role = %q, want member", got)
+	}
+}
+
+func TestRoleRanks(t *testing.T) {
+	order := []Role{RoleMember, RoleModerator, RoleAdmin, RoleOwner}
+	for i, r := range order {
+		for j, other := range order {
+			if got := r.AtLeast(other); got != (i >= j) {
+				t.Errorf("%s.AtLeast(%s) = %v", r, other, got)
+			}
+		}
+	}
+	if Role("root").Valid() || Role("").Valid() {
+		t.Error("unknown roles must be invalid")
+	}
+	room := testRoom()
+	if !CanManageMember(room, "adam", "mona") || CanManageMember(room, "mona", "adam") || CanManageMember(room, "adam", "adam") {
+		t.Error("members can only be managed by a higher role")
+	}
+	if !CanAssignRole(room, "adam", RoleModerator) || CanAssignRole(room, "adam", RoleAdmin) || CanAssignRole(room, "olga", RoleOwner) {
+		t.Error("roles can only be assigned below your own, never owner")
+	}
+}
+
+func TestCan(t *testing.T) {
+	room := testRoom()
+	cases := []struct {
+		user   string
+		action Action
+		want   bool
+	}{
+		{"mike", ReadRoom, true},
+		{"eve", ReadRoom, false},
+		{"mike", PostMessage, true},
+		{"eve", PostMessage, false},
+		{"mike", ModerateMessages, false},
+		{"mona", ModerateMessages, true},
+		{"mona", KickMember, true},
+		{"mona", ManageInvites, false},
+		{"adam", ManageInvites, true},
+		{"adam", ManageRoles, true},
+		{"adam", DeleteRoom, true},
+		{"mona", DeleteRoom, false},
+		{"adam", TransferOwnership, false},
+		{"olga", TransferOwnership, true},
+	}
+	for _, c := range cases {
+		if got := Can(c.user, room, c.action); got != c.want {
+			t.Errorf("Can(%s, %s) = %v, want %v", c.user, c.action, got, c.want)
+		}
+	}
+
+	// ownership decides, not who created the room
+	room.Roles["olga"], room.Roles["mike"] = "member", "owner"
+	if Can("olga", room, DeleteRoom) || Can("olga", room, UpdateRoom) || !Can("mike", room, DeleteRoom) {
+		t.Error("a creator who handed the room over must not update or delete it")
+	}
+
+	room.IsPrivate = false
+	if !Can("eve", room, ReadRoom) || Can("eve", room, PostMessage) {
+		t.Error("public rooms are readable, but not writable, by non-members")
+	}
+
+	dm := models.Chatroom{RoomID: models.DMRoomID("a", "b"), DMUsers: []string{"a", "b"}, Users: []string{"a", "b"}}
+	if !Can("a", dm, PostMessage) || Can("a", dm, UpdateRoom) || Can("a", dm, ManageInvites) || Can("c", dm, ReadRoom) {
+		t.Error("direct message members may only read and post")
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "root, ops")
+	if !IsAdmin("ops") || IsAdmin("mike") || IsAdmin("") {
+		t.Error("IsAdmin does not follow ADMIN_USERS")
+	}
+	if room := testRoom(); !Can("root", room, ManageInvites) || Can("root", room, ReadRoom) {
+		t.Error("server admins manage invites without reading private rooms")
+	}
+}
@@ -0,0 +1,62 @@
+package authz
+
+import "chatroom-api/models"
+
+type Role string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 4
+	case RoleAdmin:
+		return 3
+	case RoleModerator:
+		return 2
+	case RoleMember:
+		return 1
+	}
+	return 0
+}
+
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// AtLeast reports whether r is the same or a higher role than other.
+func (r Role) AtLeast(other Role) bool {
+	return r.rank() >= other.rank()
+}
+
+// RoleOf returns the role of a member, "" for non-members. Only the memberships loaded
+// into room are known. Rooms from before roles existed get an owner from the room members
+// migration (dynamodb.MigrateRoomMembers).
+func RoleOf(room models.Chatroom, username string) Role {
+	if !IsMember(room, username) {
+		return ""
+	}
+	// both sides of a direct message are equal
+	if room.IsDM() {
+		return RoleMember
+	}
+	if role, ok := room.Roles[username]; ok && Role(role).Valid() {
+		return Role(role)
+	}
+	return RoleMember
+}
+
+// CanManageMember: the actor outranks the target (kick, change role).
+func CanManageMember(room models.Chatroom, actor, target string) bool {
+	return RoleOf(room, actor).rank() > RoleOf(room, target).rank()
+}
+
+// CanAssignRole: roles can only be granted below your own, ownership is transferred instead.
+func CanAssignRole(room models.Chatroom, actor string, role Role) bool {
+	return role.Valid() && role != RoleOwner && RoleOf(room, actor).rank() > role.rank()
+}
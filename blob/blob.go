@@ -0,0 +1,122 @@
+package blob
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotFound = errors.New("blob does not exist")
+
+// Object is an opened blob, the caller closes it.
+type Object struct {
+	io.ReadCloser
+	ContentType string
+	Size        int64
+}
+
+// BlobStore keeps uploaded files. Keys are slash separated paths ("<room_id>/<attachment_id>").
+type BlobStore interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Open returns ErrNotFound for a missing key.
+	Open(key string) (*Object, error)
+	Delete(key string) error
+	// DeletePrefix removes every blob under prefix ("<room_id>/").
+	DeletePrefix(prefix string) error
+}
+
+// Default is selected in main, the local filesystem store otherwise.
+var Default BlobStore = NewFileStore("uploads")
+
+// FileStore keeps blobs as files under a directory, for single-node setups and development.
+type FileStore struct {
+	dir string
+}
+
+var _ BlobStore = (*FileStore)(nil)
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// path maps a key into the store directory, keys never escape it.
+func (s *FileStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", errors.New("invalid blob key")
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *FileStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// write to a temp file first, readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Open sniffs the content type, uploads are only accepted after the same check.
+func (s *FileStore) Open(key string) (*Object, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &Object{ReadCloser: f, ContentType: http.DetectContentType(head[:n]), Size: info.Size()}, nil
+}
+
+func (s *FileStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) DeletePrefix(prefix string) error {
+	p, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
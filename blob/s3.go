@@ -0,0 +1,144 @@
+package blob
+
+import (
+	log "chatroom-api/logger"
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Store keeps blobs in an S3 bucket. S3_ENDPOINT points it to an S3 compatible
+// stand-in (MinIO, LocalStack) with path-style addressing.
+type S3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+var _ BlobStore = (*S3Store)(nil)
+
+func NewS3Store() (*S3Store, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("S3_BUCKET is not set")
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-west-2"
+		log.Log.Warn("S3_REGION is not set, defaulting to us-west-2.")
+	}
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	endpoint := os.Getenv("S3_ENDPOINT") // local mode
+	if endpoint != "" {
+		key, secret := os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY")
+		if key == "" {
+			key, secret = "dummy", "dummy"
+		}
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(key, secret, "")))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			log.Log.Infof("current S3 Endpoint: %s", endpoint)
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &S3Store{client: client, bucket: bucket}, nil
+}
+
+// EnsureBucket creates the bucket if it does not exist yet (local stand-ins start empty).
+func (s *S3Store) EnsureBucket() error {
+	_, err := s.client.HeadBucket(context.TODO(), &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err == nil {
+		return nil
+	}
+	_, err = s.client.CreateBucket(context.TODO(), &s3.CreateBucketInput{Bucket: aws.String(s.bucket)})
+	var owned *types.BucketAlreadyOwnedByYou
+	if errors.As(err, &owned) {
+		return nil
+	}
+	if err == nil {
+		log.Log.Infof("S3 bucket [%s] created", s.bucket)
+	}
+	return err
+}
+
+func (s *S3Store) Put(key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+	})
+	if err != nil {
+		log.Log.Errorf("put object failed: key=%s, err=%v", key, err)
+	}
+	return err
+}
+
+func (s *S3Store) Open(key string) (*Object, error) {
+	out, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var missing *types.NoSuchKey
+	if errors.As(err, &missing) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		ReadCloser:  out.Body,
+		ContentType: aws.ToString(out.ContentType),
+		Size:        aws.ToInt64(out.ContentLength),
+	}, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// DeletePrefix lists the prefix and deletes it in batches of up to 1000 keys.
+func (s *S3Store) DeletePrefix(prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		ids := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			ids = append(ids, types.ObjectIdentifier{Key: obj.Key})
+		}
+		_, err = s.client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
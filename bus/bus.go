@@ -0,0 +1,57 @@
+package bus
+
+import (
+	"sync"
+)
+
+// Bus fans out room events to every instance of the server.
+// Each instance subscribes once per room that has local WebSocket clients.
+type Bus interface {
+	Publish(roomID string, payload []byte) error
+	Subscribe(roomID string, handler func(payload []byte)) error
+	Unsubscribe(roomID string) error
+	Close() error
+}
+
+// Local is the in-process Bus for single-node mode.
+type Local struct {
+	mu       sync.RWMutex
+	handlers map[string]func(payload []byte)
+}
+
+var _ Bus = (*Local)(nil)
+
+func NewLocal() *Local {
+	return &Local{handlers: make(map[string]func(payload []byte))}
+}
+
+func (b *Local) Publish(roomID string, payload []byte) error {
+	b.mu.RLock()
+	handler := b.handlers[roomID]
+	b.mu.RUnlock()
+	if handler != nil {
+		handler(payload)
+	}
+	return nil
+}
+
+func (b *Local) Subscribe(roomID string, handler func(payload []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[roomID] = handler
+	return nil
+}
+
+func (b *Local) Unsubscribe(roomID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, roomID)
+	return nil
+}
+
+func (b *Local) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = make(map[string]func(payload []byte))
+	return nil
+}
@@ -2,6 +2,8 @@ package dynamodb
 
 import (
 	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
 	"context"
 	"errors"
 	"fmt"
@@ -9,43 +11,52 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"math/rand"
+	"strconv"
 	"time"
 )
 
 var ChatroomTableName = "chatrooms" // Can be replaced with environment variable or configuration file reading
 
-type Chatroom struct {
-	RoomID    string   `json:"room_id" dynamodbav:"room_id"`
-	Name      string   `json:"name" dynamodbav:"name"`
-	IsPrivate bool     `json:"is_private" dynamodbav:"is_private"`
-	CreatedBy string   `json:"created_by" dynamodbav:"created_by"`
-	CreatedAt string   `json:"created_at" dynamodbav:"created_at"`
-	Users     []string `json:"users" dynamodbav:"users"`
-}
+type Chatroom = models.Chatroom
 
 func CreateChatroomTable() error {
 	log.Log.Info("Preparing to create the chatrooms table")
-	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
-		TableName: aws.String(ChatroomTableName),
-		AttributeDefinitions: []types.AttributeDefinition{
-			{
-				AttributeName: aws.String("room_id"),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
+	attrs := []types.AttributeDefinition{
+		{
+			AttributeName: aws.String("room_id"),
+			AttributeType: types.ScalarAttributeTypeS,
 		},
+		{AttributeName: aws.String("directory"), AttributeType: types.ScalarAttributeTypeS},
+	}
+	var indexes []types.GlobalSecondaryIndex
+	for _, sortBy := range []string{store.SortCreated, store.SortMembers, store.SortName} {
+		idx := directoryIndexes[sortBy]
+		attrs = append(attrs, types.AttributeDefinition{AttributeName: aws.String(idx.sortKey), AttributeType: idx.keyType})
+		indexes = append(indexes, types.GlobalSecondaryIndex{
+			IndexName:  aws.String(idx.name),
+			KeySchema:  directoryKeySchema(idx.sortKey),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName:            aws.String(ChatroomTableName),
+		AttributeDefinitions: attrs,
 		KeySchema: []types.KeySchemaElement{
 			{
 				AttributeName: aws.String("room_id"),
 				KeyType:       types.KeyTypeHash,
 			},
 		},
-		BillingMode: types.BillingModePayPerRequest,
+		GlobalSecondaryIndexes: indexes,
+		BillingMode:            types.BillingModePayPerRequest,
 	})
 	if err != nil {
 		var rne *types.ResourceInUseException
 		if errors.As(err, &rne) {
 			log.Log.Info(fmt.Sprintf("Chatroom table [%s] already exists, skipping creation", ChatroomTableName))
-			return nil
+			// tables created before the room directory existed
+			return EnsureDirectoryIndexes()
 		}
 
 		return fmt.Errorf("create chatroomtable [%s] failed %w", ChatroomTableName, err)
@@ -54,6 +65,7 @@ func CreateChatroomTable() error {
 	return nil
 }
 
+// CreateChatroom writes the room and its initial members (chatroom.Users) in one transaction.
 func CreateChatroom(chatroom Chatroom) error {
 	// Time formatting (standard ISO format)
 	if chatroom.CreatedAt == "" {
@@ -61,16 +73,47 @@ func CreateChatroom(chatroom Chatroom) error {
 		log.Log.Debugf("Chatroom created at: %s", chatroom.CreatedAt)
 	}
 	log.Log.Infof("Preparing to create chatroom: room_id=%s, name=%s, created_by=%s", chatroom.RoomID, chatroom.Name, chatroom.CreatedBy)
+	chatroom.MemberCount = len(chatroom.Users)
+	chatroom.SetDirectoryKeys()
 	item, err := attributevalue.MarshalMap(chatroom)
 	if err != nil {
 		log.Log.Errorf("Failed to serialize chatroom data: %v", err)
 		return err
 	}
 
-	_, err = DB.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: &ChatroomTableName,
-		Item:      item,
-	})
+	items := []types.TransactWriteItem{{
+		Put: &types.Put{
+			TableName:           aws.String(ChatroomTableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(room_id)"),
+		},
+	}}
+	for _, u := range chatroom.Users {
+		member, err := attributevalue.MarshalMap(models.Member{
+			RoomID:   chatroom.RoomID,
+			Username: u,
+			Role:     chatroom.Roles[u],
+			JoinedAt: chatroom.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+		items = append(items, types.TransactWriteItem{
+			Put: &types.Put{TableName: aws.String(MemberTableName), Item: member},
+		})
+	}
+
+	_, err = DB.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if failed := canceledBy(err); len(failed) > 0 && failed[0] {
+		log.Log.Warnf("Chatroom already exists: room_id=%s", chatroom.RoomID)
+		return store.ErrChatroomExists
+	}
+	var tce *types.TransactionCanceledException
+	if errors.As(err, &tce) {
+		// e.g. TransactionConflict with a concurrent write of the same room
+		log.Log.Warnf("Chatroom creation canceled: room_id=%s: %v", chatroom.RoomID, err)
+		return store.ErrConflict
+	}
 	if err != nil {
 		log.Log.Errorf("Failed to write chatroom data: %v", err)
 	} else {
@@ -80,6 +123,7 @@ func CreateChatroom(chatroom Chatroom) error {
 
 }
 
+// GetChatroom reads the room item, members are loaded with GetMember or ListMembers.
 func GetChatroom(chatroomId string) (Chatroom, error) {
 	var chatroom Chatroom
 	log.Log.Infof("Attempting to retrieve chatroom: room_id=%s", chatroomId)
@@ -98,7 +142,7 @@ func GetChatroom(chatroomId string) (Chatroom, error) {
 
 	if result.Item == nil {
 		log.Log.Warnf("can not find chatroom: room_id=%s", chatroomId)
-		return chatroom, fmt.Errorf("chatroom does not exist")
+		return chatroom, store.ErrChatroomNotFound
 	}
 
 	err = attributevalue.UnmarshalMap(result.Item, &chatroom)
@@ -111,105 +155,259 @@ func GetChatroom(chatroomId string) (Chatroom, error) {
 	return chatroom, nil
 }
 
-func AddUserToChatroom(username, roomID string) error {
-	log.Log.Infof("trying to add user into chatroom: user=%s, room=%s", username, roomID)
-	// get chatroom
-	chatroom, err := GetChatroom(roomID)
+// GetChatroomsByUsername queries the username index of room_members and loads the room
+// items. Only the user's own membership of each room is loaded (read position, joined_at).
+func GetChatroomsByUsername(username string) ([]Chatroom, error) {
+	log.Log.Infof("Query all chatrooms joined by the user: user=%s", username)
+	var keys, memberKeys []map[string]types.AttributeValue
+	var startKey map[string]types.AttributeValue
+	for {
+		out, err := DB.Query(context.TODO(), &dynamodb.QueryInput{
+			TableName:              aws.String(MemberTableName),
+			IndexName:              aws.String(memberUserIndex),
+			KeyConditionExpression: aws.String("username = :u"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":u": &types.AttributeValueMemberS{Value: username},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			log.Log.Errorf("query memberships failed: %v", err)
+			return nil, err
+		}
+		for _, item := range out.Items {
+			keys = append(keys, map[string]types.AttributeValue{"room_id": item["room_id"]})
+			memberKeys = append(memberKeys, item) // KEYS_ONLY: room_id + username
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+
+	results, err := batchGetChatrooms(keys)
 	if err != nil {
-		log.Log.Warnf("chatroom does not exist, failed: room_id=%s", roomID)
-		return fmt.Errorf("chatroom not exist: %w", err)
+		log.Log.Errorf("load chatrooms failed: %v", err)
+		return nil, err
 	}
+	items, err := batchGetItems(MemberTableName, memberKeys)
+	if err != nil {
+		log.Log.Errorf("load memberships failed: %v", err)
+		return nil, err
+	}
+	var members []Member
+	if err := attributevalue.UnmarshalListOfMaps(items, &members); err != nil {
+		return nil, err
+	}
+	byRoom := make(map[string]Member, len(members))
+	for _, m := range members {
+		byRoom[m.RoomID] = m
+	}
+	for i := range results {
+		if m, ok := byRoom[results[i].RoomID]; ok {
+			results[i].AddMember(m)
+		}
+	}
+	log.Log.Infof("Total number of chatrooms joined by the user: %d", len(results))
+	return results, nil
+}
 
-	// check if user is already joined
-	for _, u := range chatroom.Users {
-		if u == username {
-			log.Log.Infof("User is already in: user=%s, room=%s", username, roomID)
-			return nil
+// ScanChatroomIDs calls fn with the id of every room, page by page, for maintenance jobs.
+func ScanChatroomIDs(fn func(roomID string) error) error {
+	paginator := dynamodb.NewScanPaginator(DB, &dynamodb.ScanInput{
+		TableName:            aws.String(ChatroomTableName),
+		ProjectionExpression: aws.String("room_id"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return fmt.Errorf("scan chatrooms failed: %w", err)
+		}
+		for _, item := range out.Items {
+			var room Chatroom
+			if err := attributevalue.UnmarshalMap(item, &room); err != nil {
+				return err
+			}
+			if err := fn(room.RoomID); err != nil {
+				return err
+			}
 		}
 	}
-	log.Log.Infof("add user into chatroom user=%s, room=%s", username, roomID)
-	// add user
-	chatroom.Users = append(chatroom.Users, username)
+	return nil
+}
 
-	// write DB
-	item, err := attributevalue.MarshalMap(chatroom)
+// batchGetChatrooms loads room items 100 keys at a time (BatchGetItem maximum).
+func batchGetChatrooms(keys []map[string]types.AttributeValue) ([]Chatroom, error) {
+	items, err := batchGetItems(ChatroomTableName, keys)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = DB.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(ChatroomTableName),
-		Item:      item,
-	})
-	if err != nil {
-		log.Log.Errorf("write user data failed: %v", err)
-	} else {
-		log.Log.Infof("add user into chatroom successfully: user=%s, room=%s", username, roomID)
+	var results []Chatroom
+	if err := attributevalue.UnmarshalListOfMaps(items, &results); err != nil {
+		return nil, err
 	}
-	return err
+	return results, nil
 }
 
-func RemoveUserFromChatroom(username, roomID string) error {
-	log.Log.Infof("Tring to remove user from chatroom user=%s, room=%s", username, roomID)
-	room, err := GetChatroom(roomID)
-	if err != nil {
-		log.Log.Warnf("chatroom not exist, failed: room_id=%s", roomID)
-		return fmt.Errorf("chatroom not exist: %w", err)
+// batchGetItems reads keys in batches of 100, retrying unprocessed keys with backoff.
+func batchGetItems(table string, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	var results []map[string]types.AttributeValue
+	for start := 0; start < len(keys); start += 100 {
+		pending := keys[start:min(start+100, len(keys))]
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt >= 8 {
+				return nil, fmt.Errorf("batch get %s: %d keys still unprocessed", table, len(pending))
+			}
+			if attempt > 0 {
+				time.Sleep(time.Duration(50<<attempt) * time.Millisecond)
+			}
+			out, err := DB.BatchGetItem(context.TODO(), &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{
+					table: {Keys: pending},
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, out.Responses[table]...)
+			pending = out.UnprocessedKeys[table].Keys
+		}
 	}
+	return results, nil
+}
+
+const maxUpdateAttempts = 5
 
-	// remove user
-	var newUsers []string
-	for _, u := range room.Users {
-		if u != username {
-			newUsers = append(newUsers, u)
+// UpdateChatroom is a read-modify-write of the room item guarded by its version attribute.
+// On ConditionalCheckFailedException the room is read again and update re-applied, with
+// backoff, until maxUpdateAttempts. Members live in room_members and are not written.
+func UpdateChatroom(roomID string, update func(*Chatroom) error) (Chatroom, error) {
+	backoff := 20 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		chatroom, err := GetChatroom(roomID)
+		if err != nil {
+			return chatroom, err
+		}
+		expected := chatroom.Version
+		if err := update(&chatroom); err != nil {
+			return chatroom, err
 		}
+		chatroom.RoomID = roomID
+		chatroom.Version = expected + 1
+		chatroom.SetDirectoryKeys()
+
+		item, err := attributevalue.MarshalMap(chatroom)
+		if err != nil {
+			return chatroom, err
+		}
+		_, err = DB.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName: aws.String(ChatroomTableName),
+			Item:      item,
+			// items written before versioning have no version attribute
+			ConditionExpression:      aws.String("attribute_exists(room_id) AND (#v = :v OR attribute_not_exists(#v))"),
+			ExpressionAttributeNames: map[string]string{"#v": "version"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(expected, 10)},
+			},
+		})
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			if err != nil {
+				log.Log.Errorf("update chatroom failed: %v", err)
+			} else {
+				log.Log.Infof("chatroom updated: room_id=%s, version=%d", roomID, chatroom.Version)
+			}
+			return chatroom, err
+		}
+		if attempt >= maxUpdateAttempts {
+			log.Log.Warnf("update chatroom gave up after %d conflicts: room_id=%s", attempt, roomID)
+			return chatroom, store.ErrConflict
+		}
+		log.Log.Infof("chatroom changed concurrently, retrying: room_id=%s, attempt=%d", roomID, attempt)
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
 	}
-	room.Users = newUsers
+}
 
-	// write DB
-	item, err := attributevalue.MarshalMap(room)
+// DeleteChatroom removes the room item first, so joins and posts start failing, then its
+// memberships, messages (with their revisions and reactions) and invites in batches.
+func DeleteChatroom(roomID string) error {
+	log.Log.Infof("Deleting chatroom: room_id=%s", roomID)
+	roomKey := map[string]types.AttributeValue{"room_id": &types.AttributeValueMemberS{Value: roomID}}
+	_, err := DB.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:           aws.String(ChatroomTableName),
+		Key:                 roomKey,
+		ConditionExpression: aws.String("attribute_exists(room_id)"),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return store.ErrChatroomNotFound
+	}
 	if err != nil {
+		log.Log.Errorf("delete chatroom failed: %v", err)
 		return err
 	}
-	log.Log.Infof("remove the user from chatroom: user=%s, room=%s", username, roomID)
-	_, err = DB.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(ChatroomTableName),
-		Item:      item,
-	})
+
+	byRoom := func(table, index string) *dynamodb.QueryInput {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(table),
+			KeyConditionExpression: aws.String("room_id = :rid"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":rid": &types.AttributeValueMemberS{Value: roomID},
+			},
+		}
+		if index != "" {
+			input.IndexName = aws.String(index)
+		}
+		return input
+	}
+	members, err := deleteByQuery(byRoom(MemberTableName, ""), "room_id", "username")
 	if err != nil {
-		log.Log.Errorf("remove failed: %v", err)
-	} else {
-		log.Log.Infof("remove successfully: user=%s, room=%s", username, roomID)
+		return fmt.Errorf("delete members of room %s failed: %w", roomID, err)
 	}
-	return err
-}
-
-func GetChatroomsByUsername(username string) ([]Chatroom, error) {
-	log.Log.Infof("Query all chatrooms joined by the user: user=%s", username)
-	var results []Chatroom
-
-	// scan DB
-	output, err := DB.Scan(context.TODO(), &dynamodb.ScanInput{
-		TableName: aws.String(ChatroomTableName),
-	})
+	messages, err := deleteByQuery(byRoom(MessageTableName, ""), "room_id", "message_id")
 	if err != nil {
-		log.Log.Errorf("scan failed: %v", err)
-		return nil, err
+		return fmt.Errorf("delete messages of room %s failed: %w", roomID, err)
+	}
+	if _, err := deleteByQuery(byRoom(MessageRevisionTableName, ""), "room_id", "revision_key"); err != nil {
+		return fmt.Errorf("delete message revisions of room %s failed: %w", roomID, err)
+	}
+	if _, err := deleteByQuery(byRoom(ReactionTableName, ""), "room_id", "reaction_key"); err != nil {
+		return fmt.Errorf("delete reactions of room %s failed: %w", roomID, err)
+	}
+	invites, err := deleteByQuery(byRoom(InviteTableName, inviteRoomIndex), "code")
+	if err != nil {
+		return fmt.Errorf("delete invites of room %s failed: %w", roomID, err)
 	}
+	log.Log.Infof("Chatroom deleted: room_id=%s, members=%d, messages=%d, invites=%d", roomID, members, messages, invites)
+	return nil
+}
 
-	for _, item := range output.Items {
-		var room Chatroom
-		if err := attributevalue.UnmarshalMap(item, &room); err != nil {
-			continue
+// deleteByQuery deletes every item returned by the query, page by page. keys are the
+// primary key attributes of the table.
+func deleteByQuery(input *dynamodb.QueryInput, keys ...string) (int, error) {
+	table := aws.ToString(input.TableName)
+	deleted := 0
+	paginator := dynamodb.NewQueryPaginator(DB, input)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return deleted, err
 		}
-
-		// Find chatrooms the user has already joined
-		for _, u := range room.Users {
-			if u == username {
-				results = append(results, room)
-				break
+		for start := 0; start < len(out.Items); start += batchWriteLimit {
+			var requests []types.WriteRequest
+			for _, item := range out.Items[start:min(start+batchWriteLimit, len(out.Items))] {
+				key := map[string]types.AttributeValue{}
+				for _, k := range keys {
+					key[k] = item[k]
+				}
+				requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
 			}
+			if err := batchWrite(table, requests); err != nil {
+				return deleted, err
+			}
+			deleted += len(requests)
 		}
 	}
-	log.Log.Infof("Total number of chatrooms joined by the user: %d", len(results))
-	return results, nil
+	return deleted, nil
 }
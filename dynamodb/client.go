@@ -3,6 +3,7 @@ package dynamodb
 import (
 	log "chatroom-api/logger"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"os"
@@ -79,12 +80,27 @@ func CreateAllTables() error {
 	if err := CreateMessageTable(); err != nil {
 		errs = append(errs, fmt.Errorf("CreateMessageTable failed: %w", err))
 	}
+	if err := CreateMessageRevisionTable(); err != nil {
+		errs = append(errs, fmt.Errorf("CreateMessageRevisionTable failed: %w", err))
+	}
+	if err := CreateReactionTable(); err != nil {
+		errs = append(errs, fmt.Errorf("CreateReactionTable failed: %w", err))
+	}
+	if err := CreateMemberTable(); err != nil {
+		errs = append(errs, fmt.Errorf("CreateMemberTable failed: %w", err))
+	}
+	if err := CreateInviteTable(); err != nil {
+		errs = append(errs, fmt.Errorf("CreateInviteTable failed: %w", err))
+	}
+	if err := CreateMigrationTable(); err != nil {
+		errs = append(errs, fmt.Errorf("CreateMigrationTable failed: %w", err))
+	}
 	if len(errs) > 0 {
 		errMsg := "Table creation encountered errors:\n"
 		for _, e := range errs {
 			errMsg += " - " + e.Error() + "\n"
 		}
-		return fmt.Errorf(errMsg)
+		return errors.New(errMsg)
 	}
 
 	return nil
@@ -0,0 +1,217 @@
+package dynamodb
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The public room directory is served by sparse GSIs on the chatrooms table: only public
+// rooms have the "directory" partition key (see Chatroom.SetDirectoryKeys).
+type directoryIndex struct {
+	name    string
+	sortKey string
+	keyType types.ScalarAttributeType
+}
+
+var directoryIndexes = map[string]directoryIndex{
+	store.SortCreated: {"directory-created_at-index", "created_at", types.ScalarAttributeTypeS},
+	store.SortMembers: {"directory-member_count-index", "member_count", types.ScalarAttributeTypeN},
+	store.SortName:    {"directory-name_lower-index", "name_lower", types.ScalarAttributeTypeS},
+}
+
+// maxDirectoryReads bounds the queries of one page when filters reject most rooms.
+const maxDirectoryReads = 10
+
+// EnsureDirectoryIndexes adds the directory GSIs missing from an existing chatrooms table.
+// DynamoDB builds one index at a time: while one is being created nothing is done, otherwise
+// the first missing index is created. The others are added on later startups.
+func EnsureDirectoryIndexes() error {
+	out, err := DB.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(ChatroomTableName)})
+	if err != nil {
+		return fmt.Errorf("describe chatrooms table failed: %w", err)
+	}
+	existing := map[string]bool{}
+	for _, gsi := range out.Table.GlobalSecondaryIndexes {
+		existing[aws.ToString(gsi.IndexName)] = true
+		if gsi.IndexStatus == types.IndexStatusCreating {
+			log.Log.Infof("Index [%s] on [%s] is still being created, directory indexes are checked again on the next startup", aws.ToString(gsi.IndexName), ChatroomTableName)
+			return nil
+		}
+	}
+	for _, sortBy := range []string{store.SortCreated, store.SortMembers, store.SortName} {
+		idx := directoryIndexes[sortBy]
+		if existing[idx.name] {
+			continue
+		}
+		log.Log.Infof("Creating directory index [%s] on [%s]", idx.name, ChatroomTableName)
+		_, err := DB.UpdateTable(context.TODO(), &dynamodb.UpdateTableInput{
+			TableName: aws.String(ChatroomTableName),
+			AttributeDefinitions: []types.AttributeDefinition{
+				{AttributeName: aws.String("directory"), AttributeType: types.ScalarAttributeTypeS},
+				{AttributeName: aws.String(idx.sortKey), AttributeType: idx.keyType},
+			},
+			GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+				{Create: &types.CreateGlobalSecondaryIndexAction{
+					IndexName:  aws.String(idx.name),
+					KeySchema:  directoryKeySchema(idx.sortKey),
+					Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				}},
+			},
+		})
+		// another replica started an index build in the meantime
+		var rne *types.ResourceInUseException
+		var lee *types.LimitExceededException
+		if errors.As(err, &rne) || errors.As(err, &lee) {
+			log.Log.Infof("Chatrooms table is busy, directory index [%s] is created on a later startup: %v", idx.name, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("create directory index [%s] failed: %w", idx.name, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+func directoryKeySchema(sortKey string) []types.KeySchemaElement {
+	return []types.KeySchemaElement{
+		{AttributeName: aws.String("directory"), KeyType: types.KeyTypeHash},
+		{AttributeName: aws.String(sortKey), KeyType: types.KeyTypeRange},
+	}
+}
+
+// ListPublicChatrooms queries the directory index of q.Sort. The name prefix is a key
+// condition on the name index and a filter otherwise, the substring search is always a filter,
+// so a page may hold fewer than q.Limit rooms while NextCursor is still set.
+func ListPublicChatrooms(q store.DirectoryQuery) (store.DirectoryPage, error) {
+	var page store.DirectoryPage
+	idx, ok := directoryIndexes[q.Sort]
+	if !ok {
+		idx = directoryIndexes[store.SortCreated]
+	}
+	startKey, err := decodeDirectoryCursor(q.Cursor, idx)
+	if err != nil {
+		return page, store.ErrInvalidCursor
+	}
+
+	keyCond := "#dir = :dir" // DIRECTORY is a reserved word
+	values := map[string]types.AttributeValue{
+		":dir": &types.AttributeValueMemberS{Value: models.DirectoryPublic},
+	}
+	var filters []string
+	if q.Prefix != "" {
+		values[":prefix"] = &types.AttributeValueMemberS{Value: q.Prefix}
+		if idx.sortKey == "name_lower" {
+			keyCond += " AND begins_with(name_lower, :prefix)"
+		} else {
+			filters = append(filters, "begins_with(name_lower, :prefix)")
+		}
+	}
+	if q.Search != "" {
+		values[":search"] = &types.AttributeValueMemberS{Value: q.Search}
+		filters = append(filters, "contains(name_lower, :search)")
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(ChatroomTableName),
+		IndexName:                 aws.String(idx.name),
+		KeyConditionExpression:    aws.String(keyCond),
+		ExpressionAttributeNames:  map[string]string{"#dir": "directory"},
+		ExpressionAttributeValues: values,
+		// newest / biggest first, names A-Z
+		ScanIndexForward: aws.Bool(idx.sortKey == "name_lower"),
+	}
+	if len(filters) > 0 {
+		filter := filters[0]
+		if len(filters) > 1 {
+			filter += " AND " + filters[1]
+		}
+		input.FilterExpression = aws.String(filter)
+	}
+
+	// Limit counts evaluated items, so asking only for the missing rooms never overshoots
+	// and LastEvaluatedKey stays a valid cursor.
+	for reads := 0; reads < maxDirectoryReads && len(page.Chatrooms) < q.Limit; reads++ {
+		input.Limit = aws.Int32(int32(q.Limit - len(page.Chatrooms)))
+		input.ExclusiveStartKey = startKey
+		out, err := DB.Query(context.TODO(), input)
+		if err != nil {
+			log.Log.Errorf("query room directory failed: %v", err)
+			return page, err
+		}
+		var rooms []models.Chatroom
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &rooms); err != nil {
+			return page, err
+		}
+		page.Chatrooms = append(page.Chatrooms, rooms...)
+		startKey = out.LastEvaluatedKey
+		if len(startKey) == 0 {
+			break
+		}
+	}
+	if len(startKey) > 0 {
+		page.NextCursor, err = encodeDirectoryCursor(startKey)
+	}
+	return page, err
+}
+
+// Directory cursors are the LastEvaluatedKey (room_id, directory and the index sort key)
+// as base64url JSON.
+func encodeDirectoryCursor(key map[string]types.AttributeValue) (string, error) {
+	var plain map[string]interface{}
+	if err := attributevalue.UnmarshalMap(key, &plain); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(plain)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeDirectoryCursor only accepts the key attributes of idx: a crafted cursor or one of
+// another sort order would be rejected by DynamoDB.
+func decodeDirectoryCursor(cursor string, idx directoryIndex) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var plain map[string]interface{}
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return nil, err
+	}
+	if len(plain) != 3 {
+		return nil, fmt.Errorf("invalid cursor: %d attributes", len(plain))
+	}
+	if id, ok := plain["room_id"].(string); !ok || id == "" {
+		return nil, errors.New("invalid cursor: room_id")
+	}
+	if dir, ok := plain["directory"].(string); !ok || dir != models.DirectoryPublic {
+		return nil, errors.New("invalid cursor: directory")
+	}
+	switch plain[idx.sortKey].(type) {
+	case string:
+		if idx.keyType != types.ScalarAttributeTypeS {
+			return nil, fmt.Errorf("invalid cursor: %s", idx.sortKey)
+		}
+	case float64:
+		if idx.keyType != types.ScalarAttributeTypeN {
+			return nil, fmt.Errorf("invalid cursor: %s", idx.sortKey)
+		}
+	default:
+		return nil, fmt.Errorf("invalid cursor: %s", idx.sortKey)
+	}
+	return attributevalue.MarshalMap(plain)
+}
@@ -0,0 +1,53 @@
+package dynamodb
+
+import (
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"testing"
+)
+
+func TestDirectoryCursor(t *testing.T) {
+	byMembers := directoryIndexes[store.SortMembers]
+	key := map[string]types.AttributeValue{
+		"room_id":      &types.AttributeValueMemberS{Value: "r1"},
+		"directory":    &types.AttributeValueMemberS{Value: models.DirectoryPublic},
+		"member_count": &types.AttributeValueMemberN{Value: "42"},
+	}
+	cursor, err := encodeDirectoryCursor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeDirectoryCursor(cursor, byMembers)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if n, _ := got["member_count"].(*types.AttributeValueMemberN); n == nil || n.Value != "42" {
+		t.Fatalf("member_count = %#v, want N 42", got["member_count"])
+	}
+
+	invalid := map[string]string{
+		"other sort":   cursor,
+		"not base64":   "%%%",
+		"not json":     base64.RawURLEncoding.EncodeToString([]byte("nope")),
+		"missing key":  encode(`{"room_id":"r1","directory":"public"}`),
+		"extra key":    encode(`{"room_id":"r1","directory":"public","name_lower":"a","x":"y"}`),
+		"wrong type":   encode(`{"room_id":"r1","directory":"public","name_lower":7}`),
+		"wrong dir":    encode(`{"room_id":"r1","directory":"private","name_lower":"a"}`),
+		"empty room":   encode(`{"room_id":"","directory":"public","name_lower":"a"}`),
+		"nested value": encode(`{"room_id":"r1","directory":"public","name_lower":{"S":"a"}}`),
+	}
+	for name, c := range invalid {
+		if _, err := decodeDirectoryCursor(c, directoryIndexes[store.SortName]); err == nil {
+			t.Errorf("%s: cursor accepted", name)
+		}
+	}
+	if _, err := decodeDirectoryCursor(encode(`{"room_id":"r1","directory":"public","name_lower":"a"}`), directoryIndexes[store.SortName]); err != nil {
+		t.Errorf("name cursor rejected: %v", err)
+	}
+}
+
+func encode(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
@@ -0,0 +1,187 @@
+package dynamodb
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strconv"
+)
+
+var InviteTableName = "invites"
+
+const inviteRoomIndex = "room_id-index"
+
+type Invite = models.Invite
+
+func CreateInviteTable() error {
+	log.Log.Info("Starting to create invites table")
+	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(InviteTableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("code"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("room_id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("code"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(inviteRoomIndex),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("room_id"), KeyType: types.KeyTypeHash},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		var rne *types.ResourceInUseException
+		if errors.As(err, &rne) {
+			log.Log.Infof("Invites table [%s] already exists, skipping creation.", InviteTableName)
+			return nil
+		}
+		return fmt.Errorf("create invites table [%s] failed: %w", InviteTableName, err)
+	}
+	log.Log.Info("invites table created successfully")
+	return nil
+}
+
+func CreateInvite(invite Invite) error {
+	log.Log.Infof("Creating invite: room=%s, created_by=%s", invite.RoomID, invite.CreatedBy)
+	item, err := attributevalue.MarshalMap(invite)
+	if err != nil {
+		return err
+	}
+	_, err = DB.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:           aws.String(InviteTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(code)"),
+	})
+	if err != nil {
+		log.Log.Errorf("write invite failed: %v", err)
+	}
+	return err
+}
+
+func GetInvite(code string) (Invite, error) {
+	var invite Invite
+	out, err := DB.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(InviteTableName),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+	})
+	if err != nil {
+		return invite, err
+	}
+	if out.Item == nil {
+		return invite, store.ErrInviteNotFound
+	}
+	err = attributevalue.UnmarshalMap(out.Item, &invite)
+	return invite, err
+}
+
+func ListInvites(roomID string) ([]Invite, error) {
+	log.Log.Infof("Query invites: room=%s", roomID)
+	var invites []Invite
+	paginator := dynamodb.NewQueryPaginator(DB, &dynamodb.QueryInput{
+		TableName:              aws.String(InviteTableName),
+		IndexName:              aws.String(inviteRoomIndex),
+		KeyConditionExpression: aws.String("room_id = :rid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":rid": &types.AttributeValueMemberS{Value: roomID},
+		},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			log.Log.Errorf("query invites failed: %v", err)
+			return nil, err
+		}
+		var page []Invite
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		invites = append(invites, page...)
+	}
+	return invites, nil
+}
+
+func RevokeInvite(roomID, code string) error {
+	log.Log.Infof("Revoking invite: room=%s", roomID)
+	_, err := DB.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(InviteTableName),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+		UpdateExpression:    aws.String("SET revoked = :true"),
+		ConditionExpression: aws.String("room_id = :rid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+			":rid":  &types.AttributeValueMemberS{Value: roomID},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return store.ErrInviteNotFound
+	}
+	return err
+}
+
+// UseInvite increments uses in one conditional update, so a single-use invite can not be
+// redeemed twice by concurrent joins.
+func UseInvite(code string, now int64) error {
+	_, err := DB.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(InviteTableName),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+		UpdateExpression: aws.String("SET uses = uses + :one"),
+		ConditionExpression: aws.String("attribute_exists(code) AND revoked = :false" +
+			" AND (expires_at = :zero OR expires_at > :now)" +
+			" AND (max_uses = :zero OR uses < max_uses)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		if _, getErr := GetInvite(code); errors.Is(getErr, store.ErrInviteNotFound) {
+			return store.ErrInviteNotFound
+		}
+		return store.ErrInviteInvalid
+	}
+	return err
+}
+
+// ReleaseInvite decrements uses again, never below zero.
+func ReleaseInvite(code string) error {
+	_, err := DB.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(InviteTableName),
+		Key: map[string]types.AttributeValue{
+			"code": &types.AttributeValueMemberS{Value: code},
+		},
+		UpdateExpression:    aws.String("SET uses = uses - :one"),
+		ConditionExpression: aws.String("uses > :zero"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
+	}
+	return err
+}
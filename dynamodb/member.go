@@ -0,0 +1,415 @@
+package dynamodb
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strconv"
+	"time"
+)
+
+// Memberships are keyed by room_id + username, the username index lists the rooms of a user.
+// Joins, leaves and role changes are single-item writes.
+var MemberTableName = "room_members"
+
+const memberUserIndex = "username-index"
+
+type Member = models.Member
+
+func CreateMemberTable() error {
+	log.Log.Info("Starting to create room_members table")
+	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(MemberTableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("room_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("username"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("room_id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("username"), KeyType: types.KeyTypeRange},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(memberUserIndex),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("username"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("room_id"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeKeysOnly},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		var rne *types.ResourceInUseException
+		if errors.As(err, &rne) {
+			log.Log.Infof("Members table [%s] already exists, skipping creation.", MemberTableName)
+			return nil
+		}
+		return fmt.Errorf("create members table [%s] failed: %w", MemberTableName, err)
+	}
+	log.Log.Info("room_members table created successfully")
+	return nil
+}
+
+func memberKey(roomID, username string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"room_id":  &types.AttributeValueMemberS{Value: roomID},
+		"username": &types.AttributeValueMemberS{Value: username},
+	}
+}
+
+// canceledBy reports which items of a canceled transaction failed their condition.
+func canceledBy(err error) []bool {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return nil
+	}
+	failed := make([]bool, len(tce.CancellationReasons))
+	for i, r := range tce.CancellationReasons {
+		failed[i] = aws.ToString(r.Code) == "ConditionalCheckFailed"
+	}
+	return failed
+}
+
+// GetMember reads one membership, store.ErrNotMember if there is none.
+func GetMember(roomID, username string) (Member, error) {
+	var member Member
+	out, err := DB.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(MemberTableName),
+		Key:       memberKey(roomID, username),
+	})
+	if err != nil {
+		log.Log.Errorf("get member failed: %v", err)
+		return member, err
+	}
+	if out.Item == nil {
+		return member, store.ErrNotMember
+	}
+	err = attributevalue.UnmarshalMap(out.Item, &member)
+	return member, err
+}
+
+func ListMembers(roomID string) ([]Member, error) {
+	var members []Member
+	var startKey map[string]types.AttributeValue
+	for {
+		out, err := DB.Query(context.TODO(), &dynamodb.QueryInput{
+			TableName:              aws.String(MemberTableName),
+			KeyConditionExpression: aws.String("room_id = :rid"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":rid": &types.AttributeValueMemberS{Value: roomID},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			log.Log.Errorf("query members failed: %v", err)
+			return nil, err
+		}
+		var page []Member
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+	return members, nil
+}
+
+// AddUserToChatroom adds a plain member, joining twice is a no-op.
+func AddUserToChatroom(username, roomID string) error {
+	log.Log.Infof("trying to add user into chatroom: user=%s, room=%s", username, roomID)
+	item, err := attributevalue.MarshalMap(Member{
+		RoomID:   roomID,
+		Username: username,
+		JoinedAt: time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = DB.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Update: memberCountUpdate(roomID, 1)},
+			{Put: &types.Put{
+				TableName:           aws.String(MemberTableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(username)"),
+			}},
+		},
+	})
+	if failed := canceledBy(err); failed != nil {
+		if failed[0] {
+			log.Log.Warnf("chatroom does not exist, failed: room_id=%s", roomID)
+			return fmt.Errorf("chatroom not exist: %w", store.ErrChatroomNotFound)
+		}
+		if len(failed) > 1 && failed[1] {
+			log.Log.Infof("User is already in: user=%s, room=%s", username, roomID)
+			return nil
+		}
+	}
+	if err != nil {
+		log.Log.Errorf("write user data failed: %v", err)
+	} else {
+		log.Log.Infof("add user into chatroom successfully: user=%s, room=%s", username, roomID)
+	}
+	return err
+}
+
+func RemoveUserFromChatroom(username, roomID string) error {
+	log.Log.Infof("Tring to remove user from chatroom user=%s, room=%s", username, roomID)
+	_, err := DB.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Update: memberCountUpdate(roomID, -1)},
+			{Delete: &types.Delete{
+				TableName:           aws.String(MemberTableName),
+				Key:                 memberKey(roomID, username),
+				ConditionExpression: aws.String("attribute_exists(username)"),
+			}},
+		},
+	})
+	if failed := canceledBy(err); len(failed) > 1 && (failed[0] || failed[1]) {
+		// room or membership already gone
+		log.Log.Infof("User is not in the chatroom: user=%s, room=%s", username, roomID)
+		return nil
+	}
+	if err != nil {
+		log.Log.Errorf("remove failed: %v", err)
+	} else {
+		log.Log.Infof("remove successfully: user=%s, room=%s", username, roomID)
+	}
+	return err
+}
+
+// memberCountUpdate keeps member_count in step with the membership items. It also bumps the
+// version so a concurrent UpdateChatroom, which rewrites the whole item, retries instead of
+// writing back a stale count.
+func memberCountUpdate(roomID string, delta int) *types.Update {
+	return &types.Update{
+		TableName:                aws.String(ChatroomTableName),
+		Key:                      map[string]types.AttributeValue{"room_id": &types.AttributeValueMemberS{Value: roomID}},
+		UpdateExpression:         aws.String("ADD member_count :d, #v :one"),
+		ConditionExpression:      aws.String("attribute_exists(room_id)"),
+		ExpressionAttributeNames: map[string]string{"#v": "version"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":d":   &types.AttributeValueMemberN{Value: strconv.Itoa(delta)},
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	}
+}
+
+func memberRoleUpdate(roomID, username, role string) *types.Update {
+	update := &types.Update{
+		TableName:           aws.String(MemberTableName),
+		Key:                 memberKey(roomID, username),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+	}
+	if role == "" || role == "member" {
+		update.UpdateExpression = aws.String("REMOVE #role")
+		update.ExpressionAttributeNames = map[string]string{"#role": "role"}
+	} else {
+		update.UpdateExpression = aws.String("SET #role = :role")
+		update.ExpressionAttributeNames = map[string]string{"#role": "role"}
+		update.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":role": &types.AttributeValueMemberS{Value: role},
+		}
+	}
+	return update
+}
+
+// SetMemberRole stores a member's role, "member" removes it.
+func SetMemberRole(roomID, username, role string) error {
+	log.Log.Infof("Setting member role: room=%s, user=%s, role=%s", roomID, username, role)
+	u := memberRoleUpdate(roomID, username, role)
+	_, err := DB.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 u.TableName,
+		Key:                       u.Key,
+		UpdateExpression:          u.UpdateExpression,
+		ConditionExpression:       u.ConditionExpression,
+		ExpressionAttributeNames:  u.ExpressionAttributeNames,
+		ExpressionAttributeValues: u.ExpressionAttributeValues,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return store.ErrNotMember
+	}
+	if err != nil {
+		log.Log.Errorf("set member role failed: %v", err)
+	}
+	return err
+}
+
+// MarkRead only moves last_read_id forward, so receipts sent out of order are harmless.
+func MarkRead(roomID, username, messageID string) error {
+	_, err := DB.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:           aws.String(MemberTableName),
+		Key:                 memberKey(roomID, username),
+		UpdateExpression:    aws.String("SET last_read_id = :mid, last_read_at = :at"),
+		ConditionExpression: aws.String("attribute_exists(username) AND (attribute_not_exists(last_read_id) OR last_read_id < :mid)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":mid": &types.AttributeValueMemberS{Value: messageID},
+			":at":  &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if !errors.As(err, &ccf) {
+		if err != nil {
+			log.Log.Errorf("mark read failed: %v", err)
+		}
+		return err
+	}
+	// either not a member or already read further
+	out, err := DB.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(MemberTableName),
+		Key:       memberKey(roomID, username),
+	})
+	if err != nil {
+		return err
+	}
+	if out.Item == nil {
+		return store.ErrNotMember
+	}
+	return nil
+}
+
+// TransferOwnership makes to the owner and demotes from to admin in one transaction.
+func TransferOwnership(roomID, from, to string) error {
+	log.Log.Infof("Transferring ownership: room=%s, %s -> %s", roomID, from, to)
+	demote := memberRoleUpdate(roomID, from, "admin")
+	demote.ConditionExpression = aws.String("#role = :owner")
+	demote.ExpressionAttributeValues[":owner"] = &types.AttributeValueMemberS{Value: "owner"}
+	_, err := DB.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Update: demote},
+			{Update: memberRoleUpdate(roomID, to, "owner")},
+		},
+	})
+	if failed := canceledBy(err); len(failed) > 1 {
+		if failed[1] {
+			return store.ErrNotMember
+		}
+		if failed[0] {
+			// ownership changed since the caller checked it
+			return store.ErrConflict
+		}
+	}
+	if err != nil {
+		log.Log.Errorf("transfer ownership failed: %v", err)
+	}
+	return err
+}
+
+// legacyChatroom is a room item written before room_members existed.
+type legacyChatroom struct {
+	RoomID    string            `dynamodbav:"room_id"`
+	Name      string            `dynamodbav:"name"`
+	IsPrivate bool              `dynamodbav:"is_private"`
+	CreatedBy string            `dynamodbav:"created_by"`
+	CreatedAt string            `dynamodbav:"created_at"`
+	Users     []string          `dynamodbav:"users"`
+	Roles     map[string]string `dynamodbav:"roles"`
+}
+
+// MigrateRoomMembers moves the users/roles attributes of room items into room_members and
+// fills member_count and the directory keys. Migrated rooms lose the users attribute and
+// get member_count, so running it again only picks up rooms it missed.
+func MigrateRoomMembers() error {
+	log.Log.Infof("Migrating room members: [%s].users -> [%s]", ChatroomTableName, MemberTableName)
+	var startKey map[string]types.AttributeValue
+	rooms, total := 0, 0
+	for {
+		out, err := DB.Scan(context.TODO(), &dynamodb.ScanInput{
+			TableName:                aws.String(ChatroomTableName),
+			FilterExpression:         aws.String("attribute_exists(#users) OR attribute_not_exists(member_count)"),
+			ExpressionAttributeNames: map[string]string{"#users": "users"},
+			ExclusiveStartKey:        startKey,
+		})
+		if err != nil {
+			return fmt.Errorf("scan chatrooms failed: %w", err)
+		}
+		var legacy []legacyChatroom
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &legacy); err != nil {
+			return fmt.Errorf("unmarshal chatrooms failed: %w", err)
+		}
+		for _, room := range legacy {
+			var members []Member
+			if room.Users != nil {
+				members = legacyMembers(room)
+				if err := batchPut(MemberTableName, members); err != nil {
+					return err
+				}
+			} else if members, err = ListMembers(room.RoomID); err != nil {
+				return err
+			}
+			if err := finishRoomMigration(room, len(members)); err != nil {
+				return fmt.Errorf("update room %s failed: %w", room.RoomID, err)
+			}
+			rooms++
+			total += len(members)
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+	log.Log.Infof("Room members migration completed: %d rooms, %d members", rooms, total)
+	return nil
+}
+
+func finishRoomMigration(room legacyChatroom, memberCount int) error {
+	keys := Chatroom{Name: room.Name, IsPrivate: room.IsPrivate}
+	keys.SetDirectoryKeys()
+	update := "SET member_count = :n, #v = if_not_exists(#v, :zero) + :one"
+	values := map[string]types.AttributeValue{
+		":n":    &types.AttributeValueMemberN{Value: strconv.Itoa(memberCount)},
+		":zero": &types.AttributeValueMemberN{Value: "0"},
+		":one":  &types.AttributeValueMemberN{Value: "1"},
+	}
+	names := map[string]string{"#users": "users", "#roles": "roles", "#v": "version"}
+	if keys.Directory != "" {
+		update += ", #dir = :dir, name_lower = :nl"
+		names["#dir"] = "directory"
+		values[":dir"] = &types.AttributeValueMemberS{Value: keys.Directory}
+		values[":nl"] = &types.AttributeValueMemberS{Value: keys.NameLower}
+	}
+	_, err := DB.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(ChatroomTableName),
+		Key:                       map[string]types.AttributeValue{"room_id": &types.AttributeValueMemberS{Value: room.RoomID}},
+		UpdateExpression:          aws.String(update + " REMOVE #users, #roles"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+func legacyMembers(room legacyChatroom) []Member {
+	hasOwner := false
+	for _, role := range room.Roles {
+		if role == "owner" {
+			hasOwner = true
+		}
+	}
+	seen := map[string]bool{}
+	var members []Member
+	for _, u := range room.Users {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		role := room.Roles[u]
+		if role == "" && !hasOwner && u == room.CreatedBy {
+			role = "owner"
+		}
+		members = append(members, Member{RoomID: room.RoomID, Username: u, Role: role, JoinedAt: room.CreatedAt})
+	}
+	return members
+}
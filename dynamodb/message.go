@@ -2,6 +2,8 @@ package dynamodb
 
 import (
 	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
 	"context"
 	"errors"
 	"fmt"
@@ -9,59 +11,315 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"time"
 )
 
-import "time"
+// Messages are keyed by room_id + message_id (ULID). The legacy table was keyed by
+// room_id + timestamp (one-second resolution), see MigrateLegacyMessages.
+var MessageTableName = "messages_v2"
+var LegacyMessageTableName = "messages"
 
-var MessageTableName = "messages"
+// Replies are indexed by thread_root_id + message_id (sparse: top-level messages have no root).
+const messageThreadIndex = "thread_root_id-index"
 
-type Message struct {
-	RoomID    string `json:"room_id" dynamodbav:"room_id"`
-	Timestamp string `json:"timestamp" dynamodbav:"timestamp"`
-	Sender    string `json:"sender" dynamodbav:"sender"`
-	Text      string `json:"text" dynamodbav:"text"`
+// maxMessageReads bounds the queries of one page when the timeline filter skips many replies.
+const maxMessageReads = 10
+
+// Previous versions of edited / deleted messages, keyed by room_id + <message_id>#<ULID>.
+var MessageRevisionTableName = "message_revisions"
+
+type Message = models.Message
+
+var NewMessage = models.NewMessage
+
+// SaveMessage writes a new message. A reply is written together with the reply_count and
+// last_reply_at update of its thread root.
+func SaveMessage(msg Message) error {
+	log.Log.Infof("Saving message: room=%s, sender=%s", msg.RoomID, msg.Sender)
+	item, err := attributevalue.MarshalMap(msg)
+	if err != nil {
+		log.Log.Errorf("marshal message failed: %v", err)
+		return err
+	}
+	put := &types.Put{
+		TableName:           aws.String(MessageTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(message_id)"),
+	}
+	if msg.ThreadRootID == "" {
+		_, err = DB.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName:           put.TableName,
+			Item:                put.Item,
+			ConditionExpression: put.ConditionExpression,
+		})
+	} else {
+		_, err = DB.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{Put: put},
+				{Update: &types.Update{
+					TableName:           aws.String(MessageTableName),
+					Key:                 messageKey(msg.RoomID, msg.ThreadRootID),
+					UpdateExpression:    aws.String("ADD reply_count :one SET last_reply_at = :at"),
+					ConditionExpression: aws.String("attribute_exists(message_id)"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":one": &types.AttributeValueMemberN{Value: "1"},
+						":at":  &types.AttributeValueMemberS{Value: msg.Timestamp},
+					},
+				}},
+			},
+		})
+		if failed := canceledBy(err); len(failed) > 1 && failed[1] {
+			return store.ErrMessageNotFound
+		}
+	}
+	if err != nil {
+		log.Log.Errorf("write message failed: %v", err)
+	}
+	return err
+}
+
+func messageKey(roomID, messageID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"room_id":    &types.AttributeValueMemberS{Value: roomID},
+		"message_id": &types.AttributeValueMemberS{Value: messageID},
+	}
+}
+
+func GetMessage(roomID, messageID string) (Message, error) {
+	var msg Message
+	out, err := DB.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(MessageTableName),
+		Key:       messageKey(roomID, messageID),
+	})
+	if err != nil {
+		log.Log.Errorf("get message failed: %v", err)
+		return msg, err
+	}
+	if out.Item == nil {
+		return msg, store.ErrMessageNotFound
+	}
+	err = attributevalue.UnmarshalMap(out.Item, &msg)
+	return msg, err
+}
+
+// changeMessage updates msg and stores rev in one transaction. The update only applies
+// while the message still has the text the caller read and is not deleted.
+func changeMessage(msg Message, rev models.MessageRevision, update string, values map[string]types.AttributeValue) (Message, error) {
+	revItem, err := attributevalue.MarshalMap(rev)
+	if err != nil {
+		return msg, err
+	}
+	values[":old"] = &types.AttributeValueMemberS{Value: msg.Text}
+	values[":true"] = &types.AttributeValueMemberBOOL{Value: true}
+	_, err = DB.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Update: &types.Update{
+				TableName:                 aws.String(MessageTableName),
+				Key:                       messageKey(msg.RoomID, msg.MessageID),
+				UpdateExpression:          aws.String(update),
+				ConditionExpression:       aws.String("attribute_exists(message_id) AND #text = :old AND (attribute_not_exists(deleted) OR deleted <> :true)"),
+				ExpressionAttributeNames:  map[string]string{"#text": "text"},
+				ExpressionAttributeValues: values,
+			}},
+			{Put: &types.Put{TableName: aws.String(MessageRevisionTableName), Item: revItem}},
+		},
+	})
+	if failed := canceledBy(err); len(failed) > 0 && failed[0] {
+		if _, getErr := GetMessage(msg.RoomID, msg.MessageID); errors.Is(getErr, store.ErrMessageNotFound) {
+			return msg, store.ErrMessageNotFound
+		}
+		return msg, store.ErrConflict
+	}
+	if err != nil {
+		log.Log.Errorf("update message failed: %v", err)
+		return msg, err
+	}
+	return GetMessage(msg.RoomID, msg.MessageID)
+}
+
+func EditMessage(msg Message, text, editor string) (Message, error) {
+	log.Log.Infof("Editing message: room=%s, message=%s, by=%s", msg.RoomID, msg.MessageID, editor)
+	now := time.Now()
+	return changeMessage(msg, models.NewMessageRevision(msg, "edit", editor, now),
+		"SET #text = :text, edited_at = :at",
+		map[string]types.AttributeValue{
+			":text": &types.AttributeValueMemberS{Value: text},
+			":at":   &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+		})
 }
 
-func NewMessage(roomID, sender, text string) Message {
-	return Message{
-		RoomID:    roomID,
-		Sender:    sender,
-		Text:      text,
-		Timestamp: time.Now().Format(time.RFC3339),
+// DeleteMessage leaves a tombstone: the text is removed, sender and position stay.
+func DeleteMessage(msg Message, by string) (Message, error) {
+	log.Log.Infof("Deleting message: room=%s, message=%s, by=%s", msg.RoomID, msg.MessageID, by)
+	now := time.Now()
+	return changeMessage(msg, models.NewMessageRevision(msg, "delete", by, now),
+		"SET #text = :empty, deleted = :true, deleted_at = :at, deleted_by = :by REMOVE attachments",
+		map[string]types.AttributeValue{
+			":empty": &types.AttributeValueMemberS{Value: ""},
+			":at":    &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			":by":    &types.AttributeValueMemberS{Value: by},
+		})
+}
+
+// ListMessageRevisions returns the previous versions of a message, oldest first.
+func ListMessageRevisions(roomID, messageID string) ([]models.MessageRevision, error) {
+	var revs []models.MessageRevision
+	paginator := dynamodb.NewQueryPaginator(DB, &dynamodb.QueryInput{
+		TableName:              aws.String(MessageRevisionTableName),
+		KeyConditionExpression: aws.String("room_id = :rid AND begins_with(revision_key, :mid)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":rid": &types.AttributeValueMemberS{Value: roomID},
+			":mid": &types.AttributeValueMemberS{Value: messageID + "#"},
+		},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			log.Log.Errorf("query message revisions failed: %v", err)
+			return nil, err
+		}
+		var page []models.MessageRevision
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		revs = append(revs, page...)
 	}
+	return revs, nil
 }
 
-func GetMessagesBefore(roomID, before string, limit int) ([]Message, error) {
-	log.Log.Infof("Query historical messages: room=%s, before=%s, limit=%d", roomID, before, limit)
+// QueryMessages reads one page of a room timeline or of a thread (q.ThreadRootID, through
+// the thread index), starting next to q.Cursor. The timeline filters out replies, so it
+// queries again until the page is full. page.LastKey is the message_id of DynamoDB's
+// LastEvaluatedKey.
+func QueryMessages(q store.MessageQuery) (store.MessagePage, error) {
+	log.Log.Infof("Query historical messages: room=%s, thread=%s, cursor=%s, forward=%v, limit=%d", q.RoomID, q.ThreadRootID, q.Cursor, q.Forward, q.Limit)
+	var page store.MessagePage
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String(MessageTableName),
-		KeyConditionExpression: aws.String("room_id = :rid AND #ts < :before"),
-		ExpressionAttributeNames: map[string]string{
-			"#ts": "timestamp",
-		},
+		KeyConditionExpression: aws.String("room_id = :rid"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":rid":    &types.AttributeValueMemberS{Value: roomID},
-			":before": &types.AttributeValueMemberS{Value: before},
+			":rid": &types.AttributeValueMemberS{Value: q.RoomID},
 		},
-		Limit:            aws.Int32(int32(limit)),
-		ScanIndexForward: aws.Bool(false), // reverse order
+		FilterExpression: aws.String("attribute_not_exists(thread_root_id)"),
+		ScanIndexForward: aws.Bool(q.Forward), // false: reverse order
+	}
+	if q.ThreadRootID != "" {
+		input.IndexName = aws.String(messageThreadIndex)
+		input.KeyConditionExpression = aws.String("thread_root_id = :root")
+		input.ExpressionAttributeValues[":root"] = &types.AttributeValueMemberS{Value: q.ThreadRootID}
+		input.FilterExpression = aws.String("room_id = :rid")
+	}
+	if q.Cursor != "" {
+		op := "<"
+		if q.Forward {
+			op = ">"
+		}
+		if q.Inclusive {
+			op += "="
+		}
+		input.KeyConditionExpression = aws.String(*input.KeyConditionExpression + " AND message_id " + op + " :cursor")
+		input.ExpressionAttributeValues[":cursor"] = &types.AttributeValueMemberS{Value: q.Cursor}
 	}
 
-	resp, err := DB.Query(context.TODO(), input)
-	if err != nil {
-		log.Log.Errorf("query failed: %v", err)
-		return nil, err
+	for reads := 0; reads < maxMessageReads && len(page.Messages) < q.Limit; reads++ {
+		input.Limit = aws.Int32(int32(q.Limit - len(page.Messages)))
+		resp, err := DB.Query(context.TODO(), input)
+		if err != nil {
+			log.Log.Errorf("query failed: %v", err)
+			return page, err
+		}
+
+		var msgs []Message
+		err = attributevalue.UnmarshalListOfMaps(resp.Items, &msgs)
+		if err != nil {
+			log.Log.Errorf("unmarshal failed: %v", err)
+			return page, err
+		}
+		page.Messages = append(page.Messages, msgs...)
+		page.LastKey = ""
+		if key, ok := resp.LastEvaluatedKey["message_id"].(*types.AttributeValueMemberS); ok {
+			page.LastKey = key.Value
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
 	}
 
-	var msgs []Message
-	err = attributevalue.UnmarshalListOfMaps(resp.Items, &msgs)
+	log.Log.Infof("query %d messages successfully", len(page.Messages))
+	return page, nil
+}
+
+var messageThreadGSI = types.GlobalSecondaryIndex{
+	IndexName: aws.String(messageThreadIndex),
+	KeySchema: []types.KeySchemaElement{
+		{AttributeName: aws.String("thread_root_id"), KeyType: types.KeyTypeHash},
+		{AttributeName: aws.String("message_id"), KeyType: types.KeyTypeRange},
+	},
+	Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+}
+
+// Unread counting reads pages of unreadPageSize messages and gives up after maxUnreadPages,
+// so a room with a long backlog of filtered items (replies, own messages) stays cheap.
+const (
+	unreadPageSize = 100
+	maxUnreadPages = 5
+)
+
+// CountUnread counts with Select COUNT, so no items are transferred, and stops once limit is
+// reached. If maxUnreadPages are read before, the messages counted so far are returned as
+// capped: there are at least that many, the rest was not counted.
+func CountUnread(roomID, afterID, username string, limit int) (int, bool, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(MessageTableName),
+		KeyConditionExpression: aws.String("room_id = :rid"),
+		FilterExpression:       aws.String("attribute_not_exists(thread_root_id) AND sender <> :me"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":rid": &types.AttributeValueMemberS{Value: roomID},
+			":me":  &types.AttributeValueMemberS{Value: username},
+		},
+		Select:           types.SelectCount,
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(unreadPageSize),
+	}
+	if afterID != "" {
+		input.KeyConditionExpression = aws.String("room_id = :rid AND message_id > :after")
+		input.ExpressionAttributeValues[":after"] = &types.AttributeValueMemberS{Value: afterID}
+	}
+	n, capped, err := countPages(limit, func(start map[string]types.AttributeValue) (int, map[string]types.AttributeValue, error) {
+		input.ExclusiveStartKey = start
+		out, err := DB.Query(context.TODO(), input)
+		if err != nil {
+			return 0, nil, err
+		}
+		return int(out.Count), out.LastEvaluatedKey, nil
+	})
 	if err != nil {
-		log.Log.Errorf("unmarshal failed: %v", err)
-		return nil, err
+		log.Log.Errorf("count unread failed: %v", err)
 	}
+	return n, capped, err
+}
 
-	log.Log.Infof("query %d messages successfully", len(msgs))
-	return msgs, nil
+// countPages adds up the counts of up to maxUnreadPages pages of query. capped is set when
+// it stops before the last page, the count is a lower bound then.
+func countPages(limit int, query func(start map[string]types.AttributeValue) (int, map[string]types.AttributeValue, error)) (int, bool, error) {
+	n := 0
+	var start map[string]types.AttributeValue
+	for page := 0; page < maxUnreadPages; page++ {
+		count, last, err := query(start)
+		if err != nil {
+			return 0, false, err
+		}
+		n += count
+		if n >= limit {
+			return limit, n > limit || len(last) > 0, nil
+		}
+		if len(last) == 0 {
+			return n, false, nil
+		}
+		start = last
+	}
+	return n, true, nil
 }
 
 func CreateMessageTable() error {
@@ -70,23 +328,83 @@ func CreateMessageTable() error {
 		TableName: aws.String(MessageTableName),
 		AttributeDefinitions: []types.AttributeDefinition{
 			{AttributeName: aws.String("room_id"), AttributeType: types.ScalarAttributeTypeS},
-			{AttributeName: aws.String("timestamp"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("message_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("thread_root_id"), AttributeType: types.ScalarAttributeTypeS},
 		},
 		KeySchema: []types.KeySchemaElement{
-			{AttributeName: aws.String("room_id"), KeyType: types.KeyTypeHash},    // Partition Key
-			{AttributeName: aws.String("timestamp"), KeyType: types.KeyTypeRange}, // Sort Key
+			{AttributeName: aws.String("room_id"), KeyType: types.KeyTypeHash},     // Partition Key
+			{AttributeName: aws.String("message_id"), KeyType: types.KeyTypeRange}, // Sort Key
 		},
-		BillingMode: types.BillingModePayPerRequest,
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{messageThreadGSI},
+		BillingMode:            types.BillingModePayPerRequest,
 	})
 	if err != nil {
 		var rne *types.ResourceInUseException
 		if errors.As(err, &rne) {
-			log.Log.Info("Messages table [%s] already exists, skipping creation.", MessageTableName)
-			return nil
+			log.Log.Infof("Messages table [%s] already exists, skipping creation.", MessageTableName)
+			return EnsureThreadIndex()
 		}
 		return fmt.Errorf("create mseeages table [%s] failed: %w", MessageTableName, err)
 	}
 
-	log.Log.Info("Messages table created successfully (primary key is room_id + timestamp)")
+	log.Log.Info("Messages table created successfully (primary key is room_id + message_id)")
+	return nil
+}
+
+// EnsureThreadIndex adds the thread index to a messages table created before threads existed.
+func EnsureThreadIndex() error {
+	out, err := DB.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(MessageTableName)})
+	if err != nil {
+		return fmt.Errorf("describe messages table failed: %w", err)
+	}
+	for _, gsi := range out.Table.GlobalSecondaryIndexes {
+		if aws.ToString(gsi.IndexName) == messageThreadIndex {
+			return nil
+		}
+	}
+	log.Log.Infof("Creating thread index [%s] on [%s]", messageThreadIndex, MessageTableName)
+	_, err = DB.UpdateTable(context.TODO(), &dynamodb.UpdateTableInput{
+		TableName: aws.String(MessageTableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("thread_root_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("message_id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{Create: &types.CreateGlobalSecondaryIndexAction{
+				IndexName:  messageThreadGSI.IndexName,
+				KeySchema:  messageThreadGSI.KeySchema,
+				Projection: messageThreadGSI.Projection,
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create thread index [%s] failed: %w", messageThreadIndex, err)
+	}
+	return nil
+}
+
+func CreateMessageRevisionTable() error {
+	log.Log.Info("Starting to create message revisions table")
+	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(MessageRevisionTableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("room_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("revision_key"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("room_id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("revision_key"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		var rne *types.ResourceInUseException
+		if errors.As(err, &rne) {
+			log.Log.Infof("Message revisions table [%s] already exists, skipping creation.", MessageRevisionTableName)
+			return nil
+		}
+		return fmt.Errorf("create message revisions table [%s] failed: %w", MessageRevisionTableName, err)
+	}
+	log.Log.Info("message revisions table created successfully")
 	return nil
 }
@@ -0,0 +1,43 @@
+package dynamodb
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"testing"
+)
+
+// pages serves counts as query pages, every page but the last with a LastEvaluatedKey.
+func pages(counts ...int) (func(map[string]types.AttributeValue) (int, map[string]types.AttributeValue, error), *int) {
+	read := 0
+	return func(map[string]types.AttributeValue) (int, map[string]types.AttributeValue, error) {
+		i := read
+		read++
+		var last map[string]types.AttributeValue
+		if i+1 < len(counts) {
+			last = map[string]types.AttributeValue{"message_id": &types.AttributeValueMemberS{Value: "m"}}
+		}
+		return counts[i], last, nil
+	}, &read
+}
+
+func TestCountPages(t *testing.T) {
+	cases := []struct {
+		counts []int
+		limit  int
+		n      int
+		capped bool
+		read   int
+	}{
+		{[]int{3, 2}, 100, 5, false, 2},
+		{[]int{60, 60, 60}, 100, 100, true, 2},
+		{[]int{50, 50}, 100, 100, false, 2},
+		// filtered pages: the reads stop at maxUnreadPages with what was counted
+		{[]int{1, 0, 0, 2, 0, 7, 9}, 100, 3, true, maxUnreadPages},
+	}
+	for _, c := range cases {
+		query, read := pages(c.counts...)
+		n, capped, err := countPages(c.limit, query)
+		if err != nil || n != c.n || capped != c.capped || *read != c.read {
+			t.Errorf("countPages(%v) = %d, %v, %v after %d pages, want %d, %v after %d", c.counts, n, capped, err, *read, c.n, c.capped, c.read)
+		}
+	}
+}
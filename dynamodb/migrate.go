@@ -0,0 +1,178 @@
+package dynamodb
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/utils"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"time"
+)
+
+const batchWriteLimit = 25 // DynamoDB BatchWriteItem maximum
+
+// Completed data migrations, keyed by name, so each one runs once per deployment.
+var MigrationTableName = "schema_migrations"
+
+// Migration names, see RunMigration.
+const (
+	MigrationLegacyMessages = "legacy_messages"
+	MigrationRoomMembers    = "room_members"
+	MigrationSearchIndex    = "search_index"
+)
+
+func CreateMigrationTable() error {
+	log.Log.Info("Starting to create schema_migrations table")
+	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(MigrationTableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("name"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("name"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		var rne *types.ResourceInUseException
+		if errors.As(err, &rne) {
+			log.Log.Infof("Migrations table [%s] already exists, skipping creation.", MigrationTableName)
+			return nil
+		}
+		return fmt.Errorf("create migrations table [%s] failed: %w", MigrationTableName, err)
+	}
+	log.Log.Info("schema_migrations table created successfully")
+	return nil
+}
+
+// RunMigration runs migrate unless it completed before, force runs it again. Migrations are
+// idempotent, replicas starting at the same time may both run one.
+func RunMigration(name string, force bool, migrate func() error) error {
+	if !force {
+		out, err := DB.GetItem(context.TODO(), &dynamodb.GetItemInput{
+			TableName:      aws.String(MigrationTableName),
+			Key:            map[string]types.AttributeValue{"name": &types.AttributeValueMemberS{Value: name}},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("read migration %s failed: %w", name, err)
+		}
+		if out.Item != nil {
+			log.Log.Infof("Migration %s already completed, skipping", name)
+			return nil
+		}
+	}
+	if err := migrate(); err != nil {
+		return err
+	}
+	_, err := DB.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(MigrationTableName),
+		Item: map[string]types.AttributeValue{
+			"name":         &types.AttributeValueMemberS{Value: name},
+			"completed_at": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("record migration %s failed: %w", name, err)
+	}
+	return nil
+}
+
+// legacyMessageID derives a stable ULID for a row of the legacy table, so running the
+// migration twice writes the same items.
+func legacyMessageID(msg Message) string {
+	t, err := time.Parse(time.RFC3339, msg.Timestamp)
+	if err != nil {
+		t = time.Unix(0, 0)
+	}
+	sum := sha256.Sum256([]byte(msg.RoomID + "\x00" + msg.Timestamp + "\x00" + msg.Sender + "\x00" + msg.Text))
+	return utils.ULIDWithEntropy(t, sum[:])
+}
+
+// MigrateLegacyMessages copies the room_id + timestamp keyed table into the
+// room_id + message_id keyed table. It is idempotent and leaves the legacy table untouched.
+func MigrateLegacyMessages() error {
+	log.Log.Infof("Migrating messages: [%s] -> [%s]", LegacyMessageTableName, MessageTableName)
+	var startKey map[string]types.AttributeValue
+	total := 0
+	for {
+		out, err := DB.Scan(context.TODO(), &dynamodb.ScanInput{
+			TableName:         aws.String(LegacyMessageTableName),
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			var rnf *types.ResourceNotFoundException
+			if errors.As(err, &rnf) {
+				log.Log.Infof("Legacy messages table [%s] does not exist, nothing to migrate", LegacyMessageTableName)
+				return nil
+			}
+			return fmt.Errorf("scan legacy messages failed: %w", err)
+		}
+
+		var msgs []Message
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &msgs); err != nil {
+			return fmt.Errorf("unmarshal legacy messages failed: %w", err)
+		}
+		for i := range msgs {
+			if msgs[i].MessageID == "" {
+				msgs[i].MessageID = legacyMessageID(msgs[i])
+			}
+		}
+		if err := batchPut(MessageTableName, msgs); err != nil {
+			return err
+		}
+		total += len(msgs)
+
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+	log.Log.Infof("Messages migration completed: %d messages", total)
+	return nil
+}
+
+func batchPut[T any](table string, items []T) error {
+	for start := 0; start < len(items); start += batchWriteLimit {
+		end := min(start+batchWriteLimit, len(items))
+		var requests []types.WriteRequest
+		for _, it := range items[start:end] {
+			av, err := attributevalue.MarshalMap(it)
+			if err != nil {
+				return err
+			}
+			requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: av}})
+		}
+		if err := batchWrite(table, requests); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchWrite sends up to 25 requests, retrying unprocessed items with backoff.
+func batchWrite(table string, requests []types.WriteRequest) error {
+	backoff := 50 * time.Millisecond
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt >= 8 {
+			return fmt.Errorf("batch write to [%s]: %d items still unprocessed", table, len(requests))
+		}
+		out, err := DB.BatchWriteItem(context.TODO(), &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{table: requests},
+		})
+		if err != nil {
+			return fmt.Errorf("batch write to [%s] failed: %w", table, err)
+		}
+		requests = out.UnprocessedItems[table]
+		if len(requests) > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package dynamodb
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"sync"
+)
+
+// One item per (message, emoji, user): concurrent reactions never touch the same item,
+// counts are aggregated when messages are read.
+var ReactionTableName = "message_reactions"
+
+type Reaction = models.Reaction
+
+func CreateReactionTable() error {
+	log.Log.Info("Starting to create reactions table")
+	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(ReactionTableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("room_id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("reaction_key"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("room_id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("reaction_key"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		var rne *types.ResourceInUseException
+		if errors.As(err, &rne) {
+			log.Log.Infof("Reactions table [%s] already exists, skipping creation.", ReactionTableName)
+			return nil
+		}
+		return fmt.Errorf("create reactions table [%s] failed: %w", ReactionTableName, err)
+	}
+	log.Log.Info("reactions table created successfully")
+	return nil
+}
+
+// AddReaction writes the reaction if the message exists. Reacting twice is a no-op and
+// reports false.
+func AddReaction(r Reaction) (bool, error) {
+	item, err := attributevalue.MarshalMap(r)
+	if err != nil {
+		return false, err
+	}
+	_, err = DB.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{ConditionCheck: &types.ConditionCheck{
+				TableName:           aws.String(MessageTableName),
+				Key:                 messageKey(r.RoomID, r.MessageID),
+				ConditionExpression: aws.String("attribute_exists(message_id)"),
+			}},
+			{Put: &types.Put{
+				TableName:           aws.String(ReactionTableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(reaction_key)"),
+			}},
+		},
+	})
+	if failed := canceledBy(err); len(failed) > 1 {
+		if failed[0] {
+			return false, store.ErrMessageNotFound
+		}
+		if failed[1] {
+			return false, nil
+		}
+	}
+	if err != nil {
+		log.Log.Errorf("add reaction failed: %v", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// RemoveReaction deletes the reaction, reporting false if there was none.
+func RemoveReaction(roomID, messageID, emoji, username string) (bool, error) {
+	out, err := DB.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(ReactionTableName),
+		Key: map[string]types.AttributeValue{
+			"room_id":      &types.AttributeValueMemberS{Value: roomID},
+			"reaction_key": &types.AttributeValueMemberS{Value: models.ReactionKey(messageID, emoji, username)},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	if err != nil {
+		log.Log.Errorf("remove reaction failed: %v", err)
+		return false, err
+	}
+	return len(out.Attributes) > 0, nil
+}
+
+// maxReactionQueries bounds the concurrent queries of one ListReactions call.
+const maxReactionQueries = 8
+
+// ListReactions queries the reactions of each message (reaction_key prefix "<message_id>#"),
+// up to maxReactionQueries at a time. A range over the whole page would also read the
+// reactions of the messages in between, e.g. the rest of the room for a thread page.
+func ListReactions(roomID string, messageIDs []string) ([]Reaction, error) {
+	results := make([][]Reaction, len(messageIDs))
+	errs := make([]error, len(messageIDs))
+	sem := make(chan struct{}, maxReactionQueries)
+	var wg sync.WaitGroup
+	for i, id := range messageIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer func() { <-sem; wg.Done() }()
+			results[i], errs[i] = listMessageReactions(roomID, id)
+		}(i, id)
+	}
+	wg.Wait()
+	var reactions []Reaction
+	for i := range results {
+		if errs[i] != nil {
+			log.Log.Errorf("query reactions failed: %v", errs[i])
+			return nil, errs[i]
+		}
+		reactions = append(reactions, results[i]...)
+	}
+	return reactions, nil
+}
+
+func listMessageReactions(roomID, messageID string) ([]Reaction, error) {
+	var reactions []Reaction
+	paginator := dynamodb.NewQueryPaginator(DB, &dynamodb.QueryInput{
+		TableName:              aws.String(ReactionTableName),
+		KeyConditionExpression: aws.String("room_id = :rid AND begins_with(reaction_key, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":rid":    &types.AttributeValueMemberS{Value: roomID},
+			":prefix": &types.AttributeValueMemberS{Value: messageID + "#"},
+		},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		var page []Reaction
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, page...)
+	}
+	return reactions, nil
+}
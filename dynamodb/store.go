@@ -0,0 +1,113 @@
+package dynamodb
+
+import (
+	"chatroom-api/models"
+	"chatroom-api/store"
+)
+
+// Store adapts the package-level DynamoDB functions to store.Store.
+type Store struct{}
+
+var _ store.Store = Store{}
+
+func (Store) CreateUser(user models.User) error { return CreateUser(user) }
+
+func (Store) GetUserByUsername(username string) (*models.User, error) {
+	return GetUserByUsername(username)
+}
+
+func (Store) UpdateUserPassword(username, password string) error {
+	return UpdateUserPassword(username, password)
+}
+
+func (Store) CreateChatroom(chatroom models.Chatroom) error { return CreateChatroom(chatroom) }
+
+func (Store) GetChatroom(roomID string) (models.Chatroom, error) { return GetChatroom(roomID) }
+
+func (Store) GetMember(roomID, username string) (models.Member, error) {
+	return GetMember(roomID, username)
+}
+
+func (Store) ListMembers(roomID string) ([]models.Member, error) { return ListMembers(roomID) }
+
+func (Store) UpdateChatroom(roomID string, update func(*models.Chatroom) error) (models.Chatroom, error) {
+	return UpdateChatroom(roomID, update)
+}
+
+func (Store) DeleteChatroom(roomID string) error { return DeleteChatroom(roomID) }
+
+func (Store) AddUserToChatroom(username, roomID string) error {
+	return AddUserToChatroom(username, roomID)
+}
+
+func (Store) RemoveUserFromChatroom(username, roomID string) error {
+	return RemoveUserFromChatroom(username, roomID)
+}
+
+func (Store) GetChatroomsByUsername(username string) ([]models.Chatroom, error) {
+	return GetChatroomsByUsername(username)
+}
+
+func (Store) ListPublicChatrooms(q store.DirectoryQuery) (store.DirectoryPage, error) {
+	return ListPublicChatrooms(q)
+}
+
+func (Store) SetMemberRole(roomID, username, role string) error {
+	return SetMemberRole(roomID, username, role)
+}
+
+func (Store) MarkRead(roomID, username, messageID string) error {
+	return MarkRead(roomID, username, messageID)
+}
+
+func (Store) TransferOwnership(roomID, from, to string) error {
+	return TransferOwnership(roomID, from, to)
+}
+
+func (Store) GetMessage(roomID, messageID string) (models.Message, error) {
+	return GetMessage(roomID, messageID)
+}
+
+func (Store) EditMessage(msg models.Message, text, editor string) (models.Message, error) {
+	return EditMessage(msg, text, editor)
+}
+
+func (Store) DeleteMessage(msg models.Message, by string) (models.Message, error) {
+	return DeleteMessage(msg, by)
+}
+
+func (Store) ListMessageRevisions(roomID, messageID string) ([]models.MessageRevision, error) {
+	return ListMessageRevisions(roomID, messageID)
+}
+
+func (Store) QueryMessages(q store.MessageQuery) (store.MessagePage, error) {
+	return QueryMessages(q)
+}
+
+func (Store) SaveMessage(msg models.Message) error { return SaveMessage(msg) }
+
+func (Store) CountUnread(roomID, afterID, username string, limit int) (int, bool, error) {
+	return CountUnread(roomID, afterID, username, limit)
+}
+
+func (Store) AddReaction(r models.Reaction) (bool, error) { return AddReaction(r) }
+
+func (Store) RemoveReaction(roomID, messageID, emoji, username string) (bool, error) {
+	return RemoveReaction(roomID, messageID, emoji, username)
+}
+
+func (Store) ListReactions(roomID string, messageIDs []string) ([]models.Reaction, error) {
+	return ListReactions(roomID, messageIDs)
+}
+
+func (Store) CreateInvite(invite models.Invite) error { return CreateInvite(invite) }
+
+func (Store) GetInvite(code string) (models.Invite, error) { return GetInvite(code) }
+
+func (Store) ListInvites(roomID string) ([]models.Invite, error) { return ListInvites(roomID) }
+
+func (Store) RevokeInvite(roomID, code string) error { return RevokeInvite(roomID, code) }
+
+func (Store) UseInvite(code string, now int64) error { return UseInvite(code, now) }
+
+func (Store) ReleaseInvite(code string) error { return ReleaseInvite(code) }
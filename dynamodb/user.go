@@ -2,6 +2,8 @@ package dynamodb
 
 import (
 	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
 	"context"
 	"errors"
 	"fmt"
@@ -11,10 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-type User struct {
-	Username string `dynamodbav:"username"` //primary key
-	Password string `dynamodbav:"password"`
-}
+type User = models.User
 
 var UserTableName = "users"
 
@@ -33,6 +32,10 @@ func CreateUser(user User) error {
 	})
 	if err != nil {
 		log.Log.Warnf("User creation failed: username=%s, err=%v", user.Username, err)
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return store.ErrUserExists
+		}
 	} else {
 		log.Log.Infof("User created successfully: username=%s", user.Username)
 	}
@@ -49,11 +52,11 @@ func GetUserByUsername(username string) (*User, error) {
 	})
 	if err != nil {
 		log.Log.Errorf("Failed to query user: username=%s, err=%v", username, err)
-		return nil, errors.New("user not found")
+		return nil, store.ErrUserNotFound
 	}
 	if out.Item == nil {
 		log.Log.Warnf("user not exist: username=%s", username)
-		return nil, errors.New("user not found")
+		return nil, store.ErrUserNotFound
 	}
 
 	var user User
@@ -67,6 +70,31 @@ func GetUserByUsername(username string) (*User, error) {
 	return &user, nil
 }
 
+func UpdateUserPassword(username, password string) error {
+	log.Log.Infof("Attempting to update password: username=%s", username)
+	_, err := DB.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: &UserTableName,
+		Key: map[string]types.AttributeValue{
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+		UpdateExpression:    aws.String("SET password = :pwd"),
+		ConditionExpression: aws.String("attribute_exists(username)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pwd": &types.AttributeValueMemberS{Value: password},
+		},
+	})
+	if err != nil {
+		log.Log.Errorf("Failed to update password: username=%s, err=%v", username, err)
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return store.ErrUserNotFound
+		}
+		return err
+	}
+	log.Log.Infof("Password updated successfully: username=%s", username)
+	return nil
+}
+
 func CreateUserTable() error {
 	log.Log.Info("Starting to create users table")
 	_, err := DB.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
@@ -89,7 +117,7 @@ func CreateUserTable() error {
 		// Error handling: If the table already exists, do not return an error.
 		var rne *types.ResourceInUseException
 		if errors.As(err, &rne) {
-			log.Log.Info("User table [%s] already exists, skipping creation.", UserTableName)
+			log.Log.Infof("User table [%s] already exists, skipping creation.", UserTableName)
 			return nil
 		}
 
@@ -0,0 +1,149 @@
+package handlers_test
+
+import (
+	"bytes"
+	log "chatroom-api/logger"
+	"chatroom-api/redis"
+	"chatroom-api/router"
+	"chatroom-api/store"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// testAPI runs the full router against the in-memory store and an in-process Redis.
+type testAPI struct {
+	t   *testing.T
+	srv *httptest.Server
+	mr  *miniredis.Miniredis
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	log.Log.SetOutput(io.Discard)
+	mr := miniredis.RunT(t)
+	redis.Rdb = goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	store.Init(store.NewMemoryStore())
+	srv := httptest.NewServer(router.SetupRouter())
+	t.Cleanup(srv.Close)
+	return &testAPI{t: t, srv: srv, mr: mr}
+}
+
+// do sends body as JSON and decodes a JSON object response.
+func (a *testAPI) do(method, path, token string, body any) (int, map[string]any) {
+	a.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			a.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, a.srv.URL+path, r)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return a.send(req)
+}
+
+func (a *testAPI) send(req *http.Request) (int, map[string]any) {
+	a.t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out := map[string]any{}
+	data, _ := io.ReadAll(resp.Body)
+	_ = json.Unmarshal(data, &out)
+	return resp.StatusCode, out
+}
+
+// expect fails the test unless the request answers with status.
+func (a *testAPI) expect(status int, method, path, token string, body any) map[string]any {
+	a.t.Helper()
+	code, out := a.do(method, path, token, body)
+	if code != status {
+		a.t.Fatalf("%s %s: status %d, want %d: %v", method, path, code, status, out)
+	}
+	return out
+}
+
+// login registers username and returns its access and refresh token.
+func (a *testAPI) login(username string) (string, string) {
+	a.t.Helper()
+	creds := map[string]string{"username": username, "password": "secret-" + username}
+	a.expect(http.StatusOK, "POST", "/api/register", "", creds)
+	out := a.expect(http.StatusOK, "POST", "/api/login", "", creds)
+	return out["token"].(string), out["refresh_token"].(string)
+}
+
+// createRoom creates a room owned by the token's user and returns its id.
+func (a *testAPI) createRoom(token, name string, private bool) string {
+	a.t.Helper()
+	out := a.expect(http.StatusOK, "POST", "/api/chatrooms", token, map[string]any{"name": name, "is_private": private})
+	return out["room_id"].(string)
+}
+
+func (a *testAPI) post(token, roomID, text string) map[string]any {
+	a.t.Helper()
+	return a.expect(http.StatusOK, "POST", "/api/messages/"+roomID, token, map[string]any{"text": text})
+}
+
+func messagesOf(out map[string]any) []map[string]any {
+	var msgs []map[string]any
+	list, _ := out["messages"].([]any)
+	for _, m := range list {
+		msgs = append(msgs, m.(map[string]any))
+	}
+	return msgs
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	api := newTestAPI(t)
+	creds := map[string]string{"username": "alice", "password": "pw"}
+	api.expect(http.StatusOK, "POST", "/api/register", "", creds)
+	api.expect(http.StatusConflict, "POST", "/api/register", "", creds)
+	api.expect(http.StatusUnauthorized, "POST", "/api/login", "", map[string]string{"username": "alice", "password": "wrong"})
+	api.expect(http.StatusUnauthorized, "POST", "/api/login", "", map[string]string{"username": "nobody", "password": "pw"})
+	out := api.expect(http.StatusOK, "POST", "/api/login", "", creds)
+	if out["token"] == "" || out["refresh_token"] == "" {
+		t.Fatalf("login returned no tokens: %v", out)
+	}
+	api.expect(http.StatusUnauthorized, "GET", "/api/chatrooms", "", nil)
+	api.expect(http.StatusOK, "GET", "/api/chatrooms", out["token"].(string), nil)
+}
+
+func TestPostAndReadMessages(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	room := api.createRoom(alice, "general", false)
+
+	api.expect(http.StatusForbidden, "POST", "/api/messages/"+room, bob, map[string]any{"text": "hi"})
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, map[string]any{"chatroom_id": room})
+	api.post(alice, room, "first")
+	api.post(bob, room, "second")
+	api.expect(http.StatusBadRequest, "POST", "/api/messages/"+room, bob, map[string]any{"text": "  "})
+
+	msgs := messagesOf(api.expect(http.StatusOK, "GET", "/api/messages/"+room, alice, nil))
+	if len(msgs) != 2 || msgs[0]["text"] != "second" || msgs[1]["text"] != "first" {
+		t.Fatalf("history = %v, want second, first", msgs)
+	}
+	if msgs[0]["sender"] != "bob" {
+		t.Fatalf("sender = %v, want bob (taken from the token)", msgs[0]["sender"])
+	}
+	api.expect(http.StatusNotFound, "GET", "/api/messages/nope", alice, nil)
+}
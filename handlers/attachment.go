@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"chatroom-api/authz"
+	"chatroom-api/blob"
+	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/models"
+	"chatroom-api/redis"
+	"chatroom-api/store"
+	"chatroom-api/utils"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxMessageAttachments = 10
+
+// defaultUploadTypes are accepted unless ALLOWED_UPLOAD_TYPES is set
+var defaultUploadTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+
+var (
+	errAttachmentInvalid  = errors.New("attachment does not exist, expired or was uploaded by someone else")
+	errTooManyAttachments = fmt.Errorf("at most %d attachments per message", maxMessageAttachments)
+)
+
+// Upload settings are read on each call so values loaded from .env after package init are honored.
+
+// maxUploadSize: MAX_UPLOAD_SIZE in bytes, 10 MiB by default.
+func maxUploadSize() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("MAX_UPLOAD_SIZE"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 10 << 20
+}
+
+// attachmentURLTTL: ATTACHMENT_URL_TTL in seconds, how long a download link works (15 minutes by default).
+func attachmentURLTTL() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("ATTACHMENT_URL_TTL")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 15 * time.Minute
+}
+
+// uploadTypeAllowed checks a sniffed media type against ALLOWED_UPLOAD_TYPES (comma separated).
+func uploadTypeAllowed(mediaType string) bool {
+	types := defaultUploadTypes
+	if env := os.Getenv("ALLOWED_UPLOAD_TYPES"); env != "" {
+		types = strings.Split(env, ",")
+	}
+	for _, t := range types {
+		if strings.TrimSpace(t) == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentURL is a signed download link of a for username, see DownloadAttachment.
+func attachmentURL(a models.Attachment, username string, expires time.Time) string {
+	exp := expires.Unix()
+	q := url.Values{}
+	q.Set("name", a.FileName)
+	q.Set("u", username)
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", utils.SignFileURL(a.RoomID, a.AttachmentID, a.FileName, username, exp))
+	return "/api/files/" + a.RoomID + "/" + a.AttachmentID + "?" + q.Encode()
+}
+
+// signAttachments fills the download links of msgs for username. The attachment
+// slices are copied, they may be shared with the store.
+func signAttachments(msgs []models.Message, username string) {
+	expires := time.Now().Add(attachmentURLTTL())
+	for i := range msgs {
+		if len(msgs[i].Attachments) == 0 {
+			continue
+		}
+		attachments := append([]models.Attachment(nil), msgs[i].Attachments...)
+		for j := range attachments {
+			attachments[j].URL = attachmentURL(attachments[j], username, expires)
+		}
+		msgs[i].Attachments = attachments
+	}
+}
+
+// claimAttachments takes the uploads a new message refers to. Only the uploader can
+// attach them, to a message in the room they were uploaded to. On errors nothing stays
+// claimed; once the message is saved they are its, otherwise see redis.RestorePendingUploads.
+func claimAttachments(roomID, sender string, ids []string) ([]models.Attachment, error) {
+	if len(ids) > maxMessageAttachments {
+		return nil, errTooManyAttachments
+	}
+	var attachments []models.Attachment
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		a, err := redis.ClaimPendingUpload(roomID, id)
+		if err == nil && (a.RoomID != roomID || a.UploadedBy != sender) {
+			// not the caller's to take
+			_ = redis.RestorePendingUploads(a)
+			err = errAttachmentInvalid
+		}
+		if errors.Is(err, redis.ErrUploadNotFound) {
+			err = errAttachmentInvalid
+		}
+		if err != nil {
+			_ = redis.RestorePendingUploads(attachments...)
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// deleteAttachmentBlobs removes the files of a deleted message, failures only leave garbage.
+func deleteAttachmentBlobs(attachments []models.Attachment) {
+	for _, a := range attachments {
+		if err := blob.Default.Delete(a.BlobKey()); err != nil {
+			log.Log.Errorf("delete attachment failed: key=%s, err=%v", a.BlobKey(), err)
+		}
+	}
+}
+
+// uploadSweepInterval: how often uploads no message claimed are looked for.
+const uploadSweepInterval = 10 * time.Minute
+
+// maxUploadSweep bounds the blobs deleted per sweep, the rest wait for the next one.
+const maxUploadSweep = 1000
+
+// StartUploadSweeper periodically deletes the files of uploads that expired unclaimed,
+// see redis.SweepPendingUploads.
+func StartUploadSweeper() {
+	go func() {
+		ticker := time.NewTicker(uploadSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepUploads()
+		}
+	}()
+}
+
+func sweepUploads() {
+	keys, _ := redis.SweepPendingUploads(maxUploadSweep)
+	for _, key := range keys {
+		if err := blob.Default.Delete(key); err != nil {
+			log.Log.Errorf("delete expired upload failed: key=%s, err=%v", key, err)
+		}
+	}
+	if len(keys) > 0 {
+		log.Log.Infof("expired uploads deleted: %d", len(keys))
+	}
+}
+
+// UploadAttachment: POST /messages/:roomId/attachments with a multipart "file".
+// The upload is attached by sending a message with its attachment_id within PendingUploadTTL.
+// Attachments are broadcast without a URL, it is signed per user.
+func UploadAttachment(c *gin.Context) {
+	chatroom := middleware.Chatroom(c)
+	username := c.GetString("username")
+	// leave room for the multipart framing, the file size is checked below
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxUploadSize()+1<<20)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file is larger than %d bytes", maxUploadSize())})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	if header.Size > maxUploadSize() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file is larger than %d bytes", maxUploadSize())})
+		return
+	}
+	if header.Size == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is empty"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	defer file.Close()
+
+	// the declared content type is not trusted, the first bytes decide
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	contentType := http.DetectContentType(head[:n])
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !uploadTypeAllowed(mediaType) {
+		log.Log.Warnf("upload refused: room=%s, user=%s, type=%s", chatroom.RoomID, username, contentType)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "file type not allowed: " + mediaType})
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "upload failed"})
+		return
+	}
+
+	name := filepath.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+	if name == "." || name == "/" {
+		name = "file"
+	}
+	a := models.Attachment{
+		AttachmentID: utils.NewULID(),
+		RoomID:       chatroom.RoomID,
+		FileName:     name,
+		ContentType:  contentType,
+		Size:         header.Size,
+		UploadedBy:   username,
+		UploadedAt:   time.Now().Format(time.RFC3339),
+	}
+	if err := blob.Default.Put(a.BlobKey(), file, a.Size, contentType); err != nil {
+		log.Log.Errorf("store upload failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "upload failed"})
+		return
+	}
+	if err := redis.SavePendingUpload(a); err != nil {
+		log.Log.Errorf("save upload failed: %v", err)
+		_ = blob.Default.Delete(a.BlobKey())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "upload failed"})
+		return
+	}
+	log.Log.Infof("file uploaded: room=%s, user=%s, attachment=%s, type=%s, size=%d", a.RoomID, username, a.AttachmentID, contentType, a.Size)
+	a.URL = attachmentURL(a, username, time.Now().Add(attachmentURLTTL()))
+	c.JSON(http.StatusOK, a)
+}
+
+// GetAttachmentURL: GET /messages/:roomId/:messageId/attachments/:attachmentId
+// issues a fresh download link, e.g. for attachments received over the WebSocket.
+func GetAttachmentURL(c *gin.Context) {
+	chatroom := middleware.Chatroom(c)
+	msg, err := store.Messages.GetMessage(chatroom.RoomID, c.Param("messageId"))
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("query message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	for _, a := range msg.Attachments {
+		if a.AttachmentID == c.Param("attachmentId") {
+			expires := time.Now().Add(attachmentURLTTL())
+			c.JSON(http.StatusOK, gin.H{
+				"url":        attachmentURL(a, c.GetString("username"), expires),
+				"expires_at": expires.Format(time.RFC3339),
+			})
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "attachment not exist"})
+}
+
+// DownloadAttachment: GET /files/:roomId/:attachmentId?name=&u=&exp=&sig=
+// The link works without a token (img src, downloads) but only until it expires and
+// only while its user can still read the room.
+func DownloadAttachment(c *gin.Context) {
+	roomID := c.Param("roomId")
+	attachmentID := c.Param("attachmentId")
+	name := c.Query("name")
+	username := c.Query("u")
+	exp, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || !utils.VerifyFileURL(roomID, attachmentID, name, username, exp, c.Query("sig")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "invalid link"})
+		return
+	}
+	if time.Now().Unix() > exp {
+		c.JSON(http.StatusForbidden, gin.H{"error": "link expired"})
+		return
+	}
+	chatroom, err := store.ChatroomWith(roomID, username)
+	if err != nil || !authz.Can(username, chatroom, authz.ReadRoom) {
+		log.Log.Warnf("download denied: room=%s, attachment=%s, user=%s", roomID, attachmentID, username)
+		c.JSON(http.StatusForbidden, gin.H{"error": "permission denied: read"})
+		return
+	}
+
+	obj, err := blob.Default.Open(roomID + "/" + attachmentID)
+	if errors.Is(err, blob.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attachment not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("open attachment failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "download failed"})
+		return
+	}
+	defer obj.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(obj.ContentType, "image/") {
+		disposition = "inline"
+	}
+	c.DataFromReader(http.StatusOK, obj.Size, obj.ContentType, obj, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": name}),
+		"Cache-Control":          "private, max-age=" + strconv.FormatInt(max(exp-time.Now().Unix(), 0), 10),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
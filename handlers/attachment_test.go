@@ -0,0 +1,131 @@
+package handlers_test
+
+import (
+	"bytes"
+	"chatroom-api/blob"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"chatroom-api/utils"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var pngData = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+
+// failingSaves refuses to store new messages.
+type failingSaves struct {
+	store.MessageStore
+}
+
+func (failingSaves) SaveMessage(models.Message) error {
+	return errors.New("write failed")
+}
+
+// upload sends data as the multipart file name and returns the status and response.
+func (a *testAPI) upload(token, roomID, name string, data []byte) (int, map[string]any) {
+	a.t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, _ := w.CreateFormFile("file", name)
+	_, _ = part.Write(data)
+	_ = w.Close()
+	req, err := http.NewRequest("POST", a.srv.URL+"/api/messages/"+roomID+"/attachments", &body)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return a.send(req)
+}
+
+func (a *testAPI) download(link string) (int, []byte) {
+	a.t.Helper()
+	resp, err := http.Get(a.srv.URL + link)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+func TestAttachments(t *testing.T) {
+	api := newTestAPI(t)
+	t.Setenv("FILE_URL_SECRET", "file-secret")
+	blobs := blob.Default
+	blob.Default = blob.NewFileStore(t.TempDir())
+	t.Cleanup(func() { blob.Default = blobs })
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	carol, _ := api.login("carol")
+	room := api.createRoom(alice, "team", true)
+	code := api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/invites", alice, map[string]any{"username": "bob"})["code"]
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, map[string]any{"chatroom_id": room, "invite_code": code})
+	path := "/api/messages/" + room
+
+	if code, _ := api.upload(alice, room, "run.exe", []byte("MZ\x90\x00\x03\x00\x00\x00")); code != http.StatusUnsupportedMediaType {
+		t.Fatalf("upload of an executable: status %d, want 415", code)
+	}
+	if code, _ := api.upload(carol, room, "a.png", pngData); code != http.StatusForbidden {
+		t.Fatalf("upload by a non-member: status %d, want 403", code)
+	}
+	status, out := api.upload(alice, room, "a.png", pngData)
+	if status != http.StatusOK {
+		t.Fatalf("upload: status %d: %v", status, out)
+	}
+	mine := out["attachment_id"].(string)
+	_, out = api.upload(bob, room, "b.png", pngData)
+	theirs := out["attachment_id"].(string)
+
+	// a batch with someone else's upload claims nothing, and neither do failed saves
+	api.expect(http.StatusBadRequest, "POST", path, alice, map[string]any{"attachment_ids": []string{mine, theirs}})
+	messages := store.Messages
+	store.Messages = failingSaves{messages}
+	api.expect(http.StatusInternalServerError, "POST", path, alice, map[string]any{"attachment_ids": []string{mine}})
+	store.Messages = messages
+	msg := api.expect(http.StatusOK, "POST", path, alice, map[string]any{"text": "look", "attachment_ids": []string{mine}})
+	api.expect(http.StatusBadRequest, "POST", path, alice, map[string]any{"attachment_ids": []string{mine}})
+	api.expect(http.StatusOK, "POST", path, bob, map[string]any{"attachment_ids": []string{theirs}})
+
+	// links are signed per user
+	link := api.expect(http.StatusOK, "GET", path+"/"+msg["message_id"].(string)+"/attachments/"+mine, bob, nil)["url"].(string)
+	if code, data := api.download(link); code != http.StatusOK || !bytes.Equal(data, pngData) {
+		t.Fatalf("download: status %d, %d bytes, want the upload", code, len(data))
+	}
+	u, _ := url.Parse(link)
+	q := u.Query()
+	q.Set("u", "carol")
+	u.RawQuery = q.Encode()
+	if code, _ := api.download(u.String()); code != http.StatusForbidden {
+		t.Fatalf("download with a changed user: status %d, want 403", code)
+	}
+	// a valid link does not work for users outside the room
+	exp := time.Now().Add(time.Minute).Unix()
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", utils.SignFileURL(room, mine, q.Get("name"), "carol", exp))
+	u.RawQuery = q.Encode()
+	if code, _ := api.download(u.String()); code != http.StatusForbidden {
+		t.Fatalf("download by a non-member: status %d, want 403", code)
+	}
+	// expired links are refused
+	exp = time.Now().Add(-time.Minute).Unix()
+	q.Set("u", "bob")
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", utils.SignFileURL(room, mine, q.Get("name"), "bob", exp))
+	u.RawQuery = q.Encode()
+	if code, _ := api.download(u.String()); code != http.StatusForbidden {
+		t.Fatalf("download with an expired link: status %d, want 403", code)
+	}
+
+	// nor once its user was removed
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/members/bob/kick", alice, nil)
+	if code, _ := api.download(link); code != http.StatusForbidden {
+		t.Fatalf("download after the kick: status %d, want 403", code)
+	}
+}
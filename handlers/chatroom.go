@@ -1,25 +1,31 @@
 package handlers
 
 import (
-	"chatroom-api/dynamodb"
+	"chatroom-api/authz"
+	"chatroom-api/blob"
 	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/models"
+	"chatroom-api/redis"
+	"chatroom-api/store"
+	"chatroom-api/ws"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 var wsHost string
 
 func init() {
+	// WS_HOST points to an external WebSocket service, empty means this server handles /ws itself
 	wsHost = os.Getenv("WS_HOST")
-	if wsHost == "" {
-		wsHost = "ws://localhost:8081"
-	}
 }
 func generateRoomID() string {
 	bytes := make([]byte, 6)
@@ -27,45 +33,60 @@ func generateRoomID() string {
 	return hex.EncodeToString(bytes)
 }
 
+// The acting user always comes from the token (see middleware.Impersonation for admins),
+// request bodies and query strings never carry it.
+type CreateChatroomRequest struct {
+	Name      string `json:"name"`
+	IsPrivate bool   `json:"is_private"`
+}
+
 type JoinChatroomRequest struct {
-	Username   string `json:"username"`
 	ChatroomID string `json:"chatroom_id"`
+	InviteCode string `json:"invite_code"` // required for private rooms
+}
+
+// Fields left out are not changed. Version, if set, must match the current room version.
+type UpdateChatroomRequest struct {
+	Name      *string `json:"name"`
+	IsPrivate *bool   `json:"is_private"`
+	Version   *int64  `json:"version"`
 }
 
 type ExitChatroomRequest struct {
-	Username   string `json:"username"`
 	ChatroomID string `json:"chatroom_id"`
 }
 
 func CreateChatroom(c *gin.Context) {
 	log.Log.Info("CreateChatroom")
-	var req dynamodb.Chatroom
+	var req CreateChatroomRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		log.Log.Warn("Invalid parameter format (creating chatroom)")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
 		return
 	}
-	log.Log.Infof("Verifying if the user exists: %s", req.CreatedBy)
+	username := c.GetString("username")
+	log.Log.Infof("Verifying if the user exists: %s", username)
 
-	_, err := dynamodb.GetUserByUsername(req.CreatedBy)
+	_, err := store.Users.GetUserByUsername(username)
 	if err != nil {
-		log.Log.Warnf("User does not exist: %s", req.CreatedBy)
+		log.Log.Warnf("User does not exist: %s", username)
 		c.JSON(http.StatusNotFound, gin.H{"error": "User does not exist"})
 		return
 	}
 
 	roomID := generateRoomID()
-	log.Log.Infof("Creating chatroom: room_id=%s, created_by=%s", roomID, req.CreatedBy)
-	chatroom := dynamodb.Chatroom{
+	log.Log.Infof("Creating chatroom: room_id=%s, created_by=%s", roomID, username)
+	chatroom := models.Chatroom{
 		RoomID:    roomID,
 		Name:      req.Name,
 		IsPrivate: req.IsPrivate,
-		CreatedBy: req.CreatedBy,
+		CreatedBy: username,
 		CreatedAt: time.Now().Format(time.RFC3339),
-		Users:     []string{req.CreatedBy}, //creator directly joins
+		Users:     []string{username}, //creator directly joins
+		Roles:     map[string]string{username: string(authz.RoleOwner)},
 	}
 
-	if err := dynamodb.CreateChatroom(chatroom); err != nil {
+	if err := store.Chatrooms.CreateChatroom(chatroom); err != nil {
 		log.Log.Errorf("create chatroom failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "create chatroom failed"})
 		return
@@ -86,31 +107,55 @@ func JoinChatroom(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
 		return
 	}
-	log.Log.Infof("user tring to join chatroom: %s -> %s", req.Username, req.ChatroomID)
+	username := c.GetString("username")
+	log.Log.Infof("user tring to join chatroom: %s -> %s", username, req.ChatroomID)
 	//user status check
-	_, err := dynamodb.GetUserByUsername(req.Username)
+	_, err := store.Users.GetUserByUsername(username)
 	if err != nil {
-		log.Log.Warnf("user not exist: %s", req.Username)
+		log.Log.Warnf("user not exist: %s", username)
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not exist"})
 		return
 	}
 
 	// chatroom status check
-	_, err = dynamodb.GetChatroom(req.ChatroomID)
+	chatroom, err := store.ChatroomWith(req.ChatroomID, username)
 	if err != nil {
-		log.Log.Warnf("chatroom not exist: %s", req.Username)
+		log.Log.Warnf("chatroom not exist: %s", req.ChatroomID)
 		c.JSON(http.StatusNotFound, gin.H{"error": "chatroom not exist"})
 		return
 	}
 
+	// direct messages are reopened through POST /dm/:username
+	if chatroom.IsDM() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "direct messages can not be joined"})
+		return
+	}
+
+	// private rooms can only be joined with an invite
+	redeemed := false
+	if chatroom.IsPrivate && !authz.IsMember(chatroom, username) {
+		if status, msg := redeemInvite(req.InviteCode, req.ChatroomID, username); status != http.StatusOK {
+			log.Log.Warnf("join private chatroom refused: %s -> %s: %s", username, req.ChatroomID, msg)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		redeemed = true
+	}
+
 	// join in
-	err = dynamodb.AddUserToChatroom(req.Username, req.ChatroomID)
+	err = store.Chatrooms.AddUserToChatroom(username, req.ChatroomID)
 	if err != nil {
 		log.Log.Errorf("join failed: %v", err)
+		// the invite was not used after all
+		if redeemed {
+			if err := store.Invites.ReleaseInvite(req.InviteCode); err != nil {
+				log.Log.Errorf("release invite failed: %v", err)
+			}
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "join failed"})
 		return
 	}
-	log.Log.Infof("user join in chatroom successfully: %s -> %s", req.Username, req.ChatroomID)
+	log.Log.Infof("user join in chatroom successfully: %s -> %s", username, req.ChatroomID)
 	c.JSON(http.StatusOK, gin.H{"message": "join successfully"})
 }
 
@@ -121,107 +166,249 @@ func ExitChatroom(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
 		return
 	}
-	log.Log.Infof("User requests to leave the chatroom.: %s -> %s", req.Username, req.ChatroomID)
+	username := c.GetString("username")
+	log.Log.Infof("User requests to leave the chatroom.: %s -> %s", username, req.ChatroomID)
 	// user status check
-	_, err := dynamodb.GetUserByUsername(req.Username)
+	_, err := store.Users.GetUserByUsername(username)
 	if err != nil {
-		log.Log.Warnf("user not exist: %s", req.Username)
+		log.Log.Warnf("user not exist: %s", username)
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not exist"})
 		return
 	}
 
+	// the room must not be left without an owner
+	chatroom, err := store.ChatroomWith(req.ChatroomID, username)
+	if errors.Is(err, store.ErrChatroomNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "chatroom not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("query chatroom failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "exit failed"})
+		return
+	}
+	if authz.RoleOf(chatroom, username) == authz.RoleOwner && chatroom.MemberCount > 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "transfer ownership before leaving the chatroom"})
+		return
+	}
+
 	// remove user
-	err = dynamodb.RemoveUserFromChatroom(req.Username, req.ChatroomID)
+	err = store.Chatrooms.RemoveUserFromChatroom(username, req.ChatroomID)
 	if err != nil {
 		log.Log.Errorf("User failed to leave the chatroom: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "exit failed"})
 		return
 	}
-	log.Log.Infof("User successfully leave the chatroom: %s -> %s", req.Username, req.ChatroomID)
+	log.Log.Infof("User successfully leave the chatroom: %s -> %s", username, req.ChatroomID)
+	// also closes the user's open sockets of the room
+	ws.DefaultHub.Broadcast(ws.Event{
+		Type:   ws.EventMemberRemoved,
+		RoomID: req.ChatroomID,
+		Data:   ws.MemberEvent{Username: username},
+	})
 	c.JSON(http.StatusOK, gin.H{"message": "successful exit"})
 }
 func GetUserChatrooms(c *gin.Context) {
 	username := c.Param("username")
 	log.Log.Infof("get user chatrooms: %s", username)
 
+	// a user's room list is private, admins should impersonate instead
+	if username != c.GetString("username") {
+		log.Log.Warnf("chatroom list denied: %s -> %s", c.GetString("username"), username)
+		c.JSON(http.StatusForbidden, gin.H{"error": "can only list your own chatrooms"})
+		return
+	}
+
 	// user status check
-	_, err := dynamodb.GetUserByUsername(username)
+	_, err := store.Users.GetUserByUsername(username)
 	if err != nil {
 		log.Log.Warnf("user not exist: %s", username)
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not exist"})
 		return
 	}
 
-	chatrooms, err := dynamodb.GetChatroomsByUsername(username)
+	chatrooms, err := store.Chatrooms.GetChatroomsByUsername(username)
 	if err != nil {
 		log.Log.Errorf("Failed to query chatroom list: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
 		return
 	}
 
-	var rooms []map[string]interface{}
-	for _, room := range chatrooms {
+	// direct messages are listed apart, named after the other participant
+	var rooms, dms []map[string]interface{}
+	activity := loadRoomActivity(chatrooms, username)
+	for i, room := range chatrooms {
+		entry := gin.H{
+			"id":           room.RoomID,
+			"unread_count": activity[i].Unread,
+			"unread_more":  activity[i].UnreadCapped,
+			"last_message": activity[i].LastMessage,
+		}
+		if room.IsDM() {
+			entry["with"] = room.DMPeer(username)
+			dms = append(dms, entry)
+			continue
+		}
+		entry["name"] = room.Name
+		entry["isPrivate"] = room.IsPrivate
+		rooms = append(rooms, entry)
+	}
+	log.Log.Infof("user %s Total number of chatrooms joined: %d", username, len(chatrooms))
+	c.JSON(http.StatusOK, gin.H{"rooms": rooms, "dms": dms})
+}
+
+const maxDirectoryPageSize = 100
+
+// ListPublicChatrooms: GET /chatrooms?prefix=&q=&sort=created|members|name&limit=&cursor=
+// prefix and q (substring) match the room name case-insensitively.
+func ListPublicChatrooms(c *gin.Context) {
+	sortBy := c.DefaultQuery("sort", store.SortCreated)
+	if sortBy != store.SortCreated && sortBy != store.SortMembers && sortBy != store.SortName {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be created, members or name"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > maxDirectoryPageSize {
+		limit = maxDirectoryPageSize
+	}
+	q := store.DirectoryQuery{
+		Prefix: strings.ToLower(strings.TrimSpace(c.Query("prefix"))),
+		Search: strings.ToLower(strings.TrimSpace(c.Query("q"))),
+		Sort:   sortBy,
+		Limit:  limit,
+		Cursor: c.Query("cursor"),
+	}
+	log.Log.Infof("List public chatrooms: prefix=%s, q=%s, sort=%s, limit=%d", q.Prefix, q.Search, q.Sort, q.Limit)
+
+	page, err := store.Chatrooms.ListPublicChatrooms(q)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("list public chatrooms failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+
+	rooms := make([]gin.H, 0, len(page.Chatrooms))
+	for _, room := range page.Chatrooms {
 		rooms = append(rooms, gin.H{
-			"id":        room.RoomID,
-			"name":      room.Name,
-			"isPrivate": room.IsPrivate,
+			"id":           room.RoomID,
+			"name":         room.Name,
+			"created_by":   room.CreatedBy,
+			"created_at":   room.CreatedAt,
+			"member_count": room.MemberCount,
 		})
 	}
-	log.Log.Infof("user %s Total number of chatrooms joined: %d", username, len(chatrooms))
-	c.JSON(http.StatusOK, gin.H{"rooms": rooms})
+	c.JSON(http.StatusOK, gin.H{
+		"rooms":       rooms,
+		"has_more":    page.NextCursor != "",
+		"next_cursor": page.NextCursor,
+	})
 }
+
+// GetChatroomMessages pages through a room's history. Modes (first one set wins):
+//
+//	cursor=<next_cursor|prev_cursor>  continue from a previous page
+//	around=<message_id>               the message plus its neighbours on both sides
+//	after=<message_id|RFC3339>        newer messages
+//	before=<message_id|RFC3339>       older messages (default: latest)
+//
+// Messages are always returned newest first. next_cursor goes to older messages,
+// prev_cursor to newer ones, has_more tells whether the requested direction continues.
+// Thread replies are not part of the timeline, see GetThreadMessages.
 func GetChatroomMessages(c *gin.Context) {
 	roomID := c.Param("roomId")
-	before := c.Query("before")
-	limitStr := c.DefaultQuery("limit", "20")
-	username := c.Query("username")
-
-	log.Log.Infof("Fetching chat history: user=%s, room=%s, before=%s", username, roomID, before)
+	log.Log.Infof("Fetching chat history: user=%s, room=%s", c.GetString("username"), roomID)
 
-	if username == "" {
-		log.Log.Warn("Missing username parameter.")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing username parameter."})
+	res, ok := queryMessageHistory(c, store.MessageQuery{RoomID: roomID})
+	if !ok {
 		return
 	}
+	log.Log.Infof("Find %d messages: room=%s", len(res.Messages), roomID)
+	c.JSON(http.StatusOK, res)
+}
 
-	if before == "" {
-		before = time.Now().Format(time.RFC3339)
-	}
+// queryMessageHistory reads the page selected by the query string (see GetChatroomMessages)
+// from base. It writes the error response itself and returns false on a failure.
+func queryMessageHistory(c *gin.Context, base store.MessageQuery) (messageHistory, bool) {
+	before := parseMessageBound(c.Query("before"))
+	after := parseMessageBound(c.Query("after"))
+	around := c.Query("around")
+	cursor := c.Query("cursor")
+	limitStr := c.DefaultQuery("limit", "20")
 
 	limit, err := strconv.Atoi(limitStr)
 	if err != nil || limit <= 0 {
 		limit = 20
 	}
+	if limit > maxMessagePageSize {
+		limit = maxMessagePageSize
+	}
 
-	messages, err := dynamodb.GetMessagesBefore(roomID, before, limit)
+	if cursor != "" {
+		forward, id, ok := decodeMessageCursor(cursor)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return messageHistory{}, false
+		}
+		before, after = "", ""
+		if forward {
+			after = id
+		} else {
+			before = id
+		}
+	}
+
+	var res messageHistory
+	switch {
+	case cursor == "" && around != "":
+		res, err = messagesAround(base, around, limit)
+	case after != "":
+		res, err = messagesAfter(base, after, limit)
+	default:
+		res, err = messagesBefore(base, before, limit)
+	}
+	if errors.Is(err, store.ErrInvalidCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+		return messageHistory{}, false
+	}
 	if err != nil {
-		fmt.Println("Failed to query message:", err)
 		log.Log.Errorf("Failed to query message: %v", err)
-		c.JSON(http.StatusOK, gin.H{"messages": []dynamodb.Message{}})
-		return
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return messageHistory{}, false
 	}
-
-	if messages == nil {
-		messages = []dynamodb.Message{}
+	if err := attachReactions(res.Messages, c.GetString("username")); err != nil {
+		log.Log.Errorf("query reactions failed: %v", err)
 	}
-	log.Log.Infof("Find %d messages: room=%s", len(messages), roomID)
-	c.JSON(http.StatusOK, gin.H{"messages": messages})
+	signAttachments(res.Messages, c.GetString("username"))
+	return res, true
 }
 
 func EnterChatRoom(c *gin.Context) {
 	roomID := c.Param("roomId")
-	username := c.Query("username")
+	username := c.GetString("username")
 
 	log.Log.Infof("WebSocket request dispatching: user=%s, room=%s", username, roomID)
 
-	if roomID == "" || username == "" {
-		log.Log.Warn("Missing roomId or username parameter")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "roomId and username are required."})
-		return
+	var wsURL string
+	if wsHost != "" {
+		// external WebSocket service; like this instance it takes the user from the access
+		// token, so the username never shows up in URLs and access logs
+		wsURL = fmt.Sprintf("%s/ws/%s", wsHost, roomID)
+	} else {
+		// served by this instance, the client passes its access token, see ws.TokenProtocol
+		scheme := "ws"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "wss"
+		}
+		wsURL = fmt.Sprintf("%s://%s/ws/%s", scheme, c.Request.Host, roomID)
 	}
 
-	wsURL := fmt.Sprintf("%s/ws/%s?username=%s", wsHost, roomID, username)
-
 	c.JSON(http.StatusOK, gin.H{
 		"room_id": roomID,
 		"ws_url":  wsURL,
@@ -242,16 +429,89 @@ func GetChatroomByRoomID(c *gin.Context) {
 	roomID := c.Param("roomId")
 	log.Log.Infof("Query chatroom details: room_id=%s", roomID)
 
-	chatroom, err := dynamodb.GetChatroom(roomID)
-	if err != nil {
-		log.Log.Warnf("query chatroom failed: %v", err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "chatroom not exist"})
-		return
-	}
+	chatroom := middleware.Chatroom(c)
 	log.Log.Infof("query successfully: room_id=%s", roomID)
 	c.JSON(http.StatusOK, gin.H{
 		"id":        chatroom.RoomID,
 		"name":      chatroom.Name,
 		"isPrivate": chatroom.IsPrivate,
+		"version":   chatroom.Version,
+	})
+}
+
+func UpdateChatroom(c *gin.Context) {
+	roomID := c.Param("roomId")
+	username := c.GetString("username")
+	var req UpdateChatroomRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Log.Warn("Invalid parameter format (update chatroom)")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
+		return
+	}
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must not be empty"})
+		return
+	}
+
+	chatroom, err := store.Chatrooms.UpdateChatroom(roomID, func(room *models.Chatroom) error {
+		if req.Version != nil && *req.Version != room.Version {
+			return store.ErrConflict
+		}
+		if req.Name != nil {
+			room.Name = strings.TrimSpace(*req.Name)
+		}
+		if req.IsPrivate != nil {
+			room.IsPrivate = *req.IsPrivate
+		}
+		return nil
 	})
+	switch {
+	case errors.Is(err, store.ErrChatroomNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "chatroom not exist"})
+		return
+	case errors.Is(err, store.ErrConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "chatroom was changed by another request, reload and retry"})
+		return
+	case err != nil:
+		log.Log.Errorf("update chatroom failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+		return
+	}
+	log.Log.Infof("chatroom updated: room_id=%s, by=%s, version=%d", roomID, username, chatroom.Version)
+
+	room := gin.H{
+		"id":        chatroom.RoomID,
+		"name":      chatroom.Name,
+		"isPrivate": chatroom.IsPrivate,
+		"version":   chatroom.Version,
+	}
+	ws.DefaultHub.Broadcast(ws.Event{Type: "room_updated", RoomID: roomID, Data: room})
+	c.JSON(http.StatusOK, room)
+}
+
+// DeleteChatroom deletes the room with its members, messages, invites and attachments, and
+// disconnects its WebSocket clients.
+func DeleteChatroom(c *gin.Context) {
+	roomID := c.Param("roomId")
+	username := c.GetString("username")
+	log.Log.Infof("Delete chatroom: room_id=%s, by=%s", roomID, username)
+
+	err := store.Chatrooms.DeleteChatroom(roomID)
+	if errors.Is(err, store.ErrChatroomNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "chatroom not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("delete chatroom failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "delete failed"})
+		return
+	}
+	if err := redis.DeleteSearchIndex(roomID); err != nil {
+		log.Log.Errorf("delete search index failed: room=%s, err=%v", roomID, err)
+	}
+	if err := blob.Default.DeletePrefix(roomID + "/"); err != nil {
+		log.Log.Errorf("delete attachments failed: room=%s, err=%v", roomID, err)
+	}
+	ws.DefaultHub.Broadcast(ws.Event{Type: ws.EventRoomDeleted, RoomID: roomID, Data: gin.H{"by": username}})
+	c.JSON(http.StatusOK, gin.H{"message": "chatroom deleted"})
 }
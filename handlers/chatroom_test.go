@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnterChatRoomExternalHost(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	host := wsHost
+	wsHost = "wss://ws.example.com"
+	t.Cleanup(func() { wsHost = host })
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/api/chatrooms/r1/enter", nil)
+	c.Params = gin.Params{{Key: "roomId", Value: "r1"}}
+	c.Set("username", "alice")
+	EnterChatRoom(c)
+
+	var out map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &out)
+	// the user comes from the access token, not the URL
+	if out["ws_url"] != "wss://ws.example.com/ws/r1" {
+		t.Fatalf("ws_url = %q, want wss://ws.example.com/ws/r1", out["ws_url"])
+	}
+}
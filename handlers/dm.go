@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"chatroom-api/authz"
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// maxDMCreateAttempts bounds the retries when concurrent creates of the same room cancel each other.
+const maxDMCreateAttempts = 3
+
+// OpenDirectMessage: POST /dm/:username returns the direct message room with that user,
+// creating it on first use. The room id is derived from the pair, so concurrent
+// requests of both users end up in the same room. A participant who left is added back.
+func OpenDirectMessage(c *gin.Context) {
+	username := c.GetString("username")
+	peer := c.Param("username")
+	if peer == username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "can not send direct messages to yourself"})
+		return
+	}
+	if _, err := store.Users.GetUserByUsername(peer); err != nil {
+		log.Log.Warnf("user not exist: %s", peer)
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not exist"})
+		return
+	}
+
+	roomID := models.DMRoomID(username, peer)
+	users := models.DMUsersOf(username, peer)
+	created := false
+	chatroom, err := store.ChatroomWith(roomID, users...)
+	for attempt := 0; errors.Is(err, store.ErrChatroomNotFound) && attempt < maxDMCreateAttempts; attempt++ {
+		room := models.Chatroom{
+			RoomID:    roomID,
+			IsPrivate: true,
+			CreatedBy: username,
+			CreatedAt: time.Now().Format(time.RFC3339),
+			Users:     users,
+			DMUsers:   users,
+		}
+		err = store.Chatrooms.CreateChatroom(room)
+		if err == nil {
+			chatroom, created = room, true
+			break
+		}
+		// the other side opened it at the same time, their write may have canceled ours
+		if errors.Is(err, store.ErrChatroomExists) || errors.Is(err, store.ErrConflict) {
+			chatroom, err = store.ChatroomWith(roomID, users...)
+		}
+	}
+	if err != nil {
+		log.Log.Errorf("open direct message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "open direct message failed"})
+		return
+	}
+
+	for _, u := range users {
+		if authz.IsMember(chatroom, u) {
+			continue
+		}
+		if err := store.Chatrooms.AddUserToChatroom(u, roomID); err != nil {
+			log.Log.Errorf("rejoin direct message failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "open direct message failed"})
+			return
+		}
+	}
+	if created {
+		log.Log.Infof("direct message created: room_id=%s, %s <-> %s", roomID, username, peer)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"room_id": roomID,
+		"with":    peer,
+		"created": created,
+	})
+}
@@ -0,0 +1,47 @@
+package handlers_test
+
+import (
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"net/http"
+	"testing"
+)
+
+// racingCreates lets the other participant's create win: the room is written, but the
+// caller's transaction is canceled.
+type racingCreates struct {
+	store.ChatroomStore
+}
+
+func (r racingCreates) CreateChatroom(chatroom models.Chatroom) error {
+	if err := r.ChatroomStore.CreateChatroom(chatroom); err != nil {
+		return err
+	}
+	return store.ErrConflict
+}
+
+func TestDirectMessages(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	carol, _ := api.login("carol")
+
+	api.expect(http.StatusBadRequest, "POST", "/api/dm/alice", alice, nil)
+	api.expect(http.StatusNotFound, "POST", "/api/dm/nobody", alice, nil)
+
+	chatrooms := store.Chatrooms
+	store.Chatrooms = racingCreates{chatrooms}
+	out := api.expect(http.StatusOK, "POST", "/api/dm/bob", alice, nil)
+	store.Chatrooms = chatrooms
+	if out["created"] != false {
+		t.Fatalf("created = %v, want false: the concurrent request created the room", out["created"])
+	}
+	room := out["room_id"].(string)
+	if again := api.expect(http.StatusOK, "POST", "/api/dm/alice", bob, nil); again["room_id"] != room {
+		t.Fatalf("room of bob = %v, want %s", again["room_id"], room)
+	}
+
+	api.post(bob, room, "hi")
+	api.expect(http.StatusForbidden, "GET", "/api/messages/"+room, carol, nil)
+	api.expect(http.StatusForbidden, "POST", "/api/chatrooms/join", carol, map[string]any{"chatroom_id": room})
+}
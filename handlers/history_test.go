@@ -0,0 +1,72 @@
+package handlers_test
+
+import (
+	"chatroom-api/store"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func texts(msgs []map[string]any) string {
+	out := ""
+	for _, m := range msgs {
+		out += fmt.Sprint(m["text"]) + " "
+	}
+	return out
+}
+
+func TestMessageHistoryPaging(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	room := api.createRoom(alice, "general", false)
+	var ids []string
+	for i := 1; i <= 5; i++ {
+		ids = append(ids, api.post(alice, room, fmt.Sprint(i))["message_id"].(string))
+	}
+	path := "/api/messages/" + room
+
+	first := api.expect(http.StatusOK, "GET", path+"?limit=2", alice, nil)
+	if got := texts(messagesOf(first)); got != "5 4 " || first["has_more"] != true {
+		t.Fatalf("first page = %q, has_more %v", got, first["has_more"])
+	}
+	second := api.expect(http.StatusOK, "GET", path+"?limit=2&cursor="+first["next_cursor"].(string), alice, nil)
+	if got := texts(messagesOf(second)); got != "3 2 " {
+		t.Fatalf("second page = %q", got)
+	}
+	back := api.expect(http.StatusOK, "GET", path+"?limit=2&cursor="+second["prev_cursor"].(string), alice, nil)
+	if got := texts(messagesOf(back)); got != "5 4 " {
+		t.Fatalf("back to newer = %q", got)
+	}
+
+	after := api.expect(http.StatusOK, "GET", path+"?after="+ids[2], alice, nil)
+	if got := texts(messagesOf(after)); got != "5 4 " {
+		t.Fatalf("after 3 = %q", got)
+	}
+	around := api.expect(http.StatusOK, "GET", path+"?limit=3&around="+ids[2], alice, nil)
+	if got := texts(messagesOf(around)); got != "4 3 2 " {
+		t.Fatalf("around 3 = %q", got)
+	}
+	api.expect(http.StatusBadRequest, "GET", path+"?cursor=garbage", alice, nil)
+}
+
+// failingHistory fails every history query.
+type failingHistory struct {
+	store.MessageStore
+}
+
+func (failingHistory) QueryMessages(q store.MessageQuery) (store.MessagePage, error) {
+	return store.MessagePage{}, errors.New("read failed")
+}
+
+func TestMessageHistoryStoreError(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	room := api.createRoom(alice, "general", false)
+	api.post(alice, room, "hello")
+
+	messages := store.Messages
+	store.Messages = failingHistory{messages}
+	defer func() { store.Messages = messages }()
+	api.expect(http.StatusInternalServerError, "GET", "/api/messages/"+room, alice, nil)
+}
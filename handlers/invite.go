@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+const defaultInviteTTL = 7 * 24 * time.Hour
+
+type CreateInviteRequest struct {
+	MaxUses   *int   `json:"max_uses"`   // default 1 (single-use), 0 = unlimited
+	ExpiresIn *int64 `json:"expires_in"` // seconds, default 7 days, 0 = never
+	Username  string `json:"username"`   // optional: only this user may use the invite
+}
+
+func generateInviteCode() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func CreateInvite(c *gin.Context) {
+	roomID := c.Param("roomId")
+	username := c.GetString("username")
+	var req CreateInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Log.Warn("Invalid parameter format (create invite)")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
+		return
+	}
+
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+	ttl := defaultInviteTTL
+	if req.ExpiresIn != nil {
+		ttl = time.Duration(*req.ExpiresIn) * time.Second
+	}
+	if maxUses < 0 || ttl < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_uses and expires_in must not be negative"})
+		return
+	}
+	if req.Username != "" {
+		if _, err := store.Users.GetUserByUsername(req.Username); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not exist"})
+			return
+		}
+	}
+
+	now := time.Now()
+	invite := models.Invite{
+		Code:       generateInviteCode(),
+		RoomID:     roomID,
+		CreatedBy:  username,
+		CreatedAt:  now.Format(time.RFC3339),
+		MaxUses:    maxUses,
+		TargetUser: req.Username,
+	}
+	if ttl > 0 {
+		invite.ExpiresAt = now.Add(ttl).Unix()
+	}
+	if err := store.Invites.CreateInvite(invite); err != nil {
+		log.Log.Errorf("create invite failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "create invite failed"})
+		return
+	}
+	log.Log.Infof("invite created: room=%s, by=%s, max_uses=%d, target=%s", roomID, username, maxUses, req.Username)
+	c.JSON(http.StatusOK, invite)
+}
+
+func ListInvites(c *gin.Context) {
+	roomID := c.Param("roomId")
+	invites, err := store.Invites.ListInvites(roomID)
+	if err != nil {
+		log.Log.Errorf("list invites failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if invites == nil {
+		invites = []models.Invite{}
+	}
+	c.JSON(http.StatusOK, gin.H{"invites": invites})
+}
+
+func RevokeInvite(c *gin.Context) {
+	roomID := c.Param("roomId")
+	err := store.Invites.RevokeInvite(roomID, c.Param("code"))
+	if errors.Is(err, store.ErrInviteNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invite not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("revoke invite failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+		return
+	}
+	log.Log.Infof("invite revoked: room=%s, by=%s", roomID, c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{"message": "invite revoked"})
+}
+
+// redeemInvite checks that code lets username into roomID and consumes one use,
+// the caller gives it back with store.Invites.ReleaseInvite if the join fails.
+// It returns the HTTP status and error message to send when the invite is refused.
+func redeemInvite(code, roomID, username string) (int, string) {
+	if code == "" {
+		return http.StatusForbidden, "an invite is required to join this private chatroom"
+	}
+	invite, err := store.Invites.GetInvite(code)
+	if err != nil && !errors.Is(err, store.ErrInviteNotFound) {
+		log.Log.Errorf("query invite failed: %v", err)
+		return http.StatusInternalServerError, "join failed"
+	}
+	if err != nil || invite.RoomID != roomID {
+		return http.StatusForbidden, "invalid invite"
+	}
+	if invite.TargetUser != "" && invite.TargetUser != username {
+		return http.StatusForbidden, "this invite is for another user"
+	}
+	err = store.Invites.UseInvite(code, time.Now().Unix())
+	if errors.Is(err, store.ErrInviteInvalid) || errors.Is(err, store.ErrInviteNotFound) {
+		return http.StatusForbidden, store.ErrInviteInvalid.Error()
+	}
+	if err != nil {
+		log.Log.Errorf("use invite failed: %v", err)
+		return http.StatusInternalServerError, "join failed"
+	}
+	return http.StatusOK, ""
+}
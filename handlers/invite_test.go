@@ -0,0 +1,53 @@
+package handlers_test
+
+import (
+	"chatroom-api/store"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// failingJoins makes every join fail after the invite check.
+type failingJoins struct {
+	store.ChatroomStore
+}
+
+func (failingJoins) AddUserToChatroom(username, roomID string) error {
+	return errors.New("write failed")
+}
+
+func TestPrivateRoomInvites(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	carol, _ := api.login("carol")
+	room := api.createRoom(alice, "secret", true)
+
+	api.expect(http.StatusForbidden, "POST", "/api/chatrooms/join", bob, map[string]any{"chatroom_id": room})
+	invite := api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/invites", alice, map[string]any{"max_uses": 1})
+	code := invite["code"].(string)
+	api.expect(http.StatusForbidden, "POST", "/api/chatrooms/"+room+"/invites", bob, map[string]any{})
+
+	join := map[string]any{"chatroom_id": room, "invite_code": code}
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, join)
+	api.expect(http.StatusForbidden, "POST", "/api/chatrooms/join", carol, join)
+
+	targeted := api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/invites", alice, map[string]any{"username": "bob"})
+	api.expect(http.StatusForbidden, "POST", "/api/chatrooms/join", carol, map[string]any{"chatroom_id": room, "invite_code": targeted["code"]})
+}
+
+func TestFailedJoinKeepsInviteUse(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	room := api.createRoom(alice, "secret", true)
+	code := api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/invites", alice, map[string]any{"max_uses": 1})["code"]
+	join := map[string]any{"chatroom_id": room, "invite_code": code}
+
+	chatrooms := store.Chatrooms
+	store.Chatrooms = failingJoins{chatrooms}
+	api.expect(http.StatusInternalServerError, "POST", "/api/chatrooms/join", bob, join)
+	store.Chatrooms = chatrooms
+
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, join)
+}
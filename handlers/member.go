@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"chatroom-api/authz"
+	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"chatroom-api/ws"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type SetRoleRequest struct {
+	Role string `json:"role"` // admin, moderator or member
+}
+
+type TransferOwnershipRequest struct {
+	Username string `json:"username"`
+}
+
+type RoomMember struct {
+	Username string     `json:"username"`
+	Role     authz.Role `json:"role"`
+}
+
+func ListMembers(c *gin.Context) {
+	chatroom, err := store.ChatroomWithMembers(c.Param("roomId"))
+	if err != nil {
+		log.Log.Errorf("query members failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	members := make([]RoomMember, 0, len(chatroom.Users))
+	for _, u := range chatroom.Users {
+		members = append(members, RoomMember{Username: u, Role: authz.RoleOf(chatroom, u)})
+	}
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// withMember adds the membership of target to the room loaded by RoomAccess. It answers
+// 404 and returns false if target is not a member.
+func withMember(c *gin.Context, target string) (models.Chatroom, bool) {
+	chatroom := middleware.Chatroom(c)
+	m, err := store.Chatrooms.GetMember(chatroom.RoomID, target)
+	if errors.Is(err, store.ErrNotMember) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user is not a member of this chatroom"})
+		return chatroom, false
+	}
+	if err != nil {
+		log.Log.Errorf("query member failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return chatroom, false
+	}
+	if !authz.IsMember(chatroom, target) {
+		chatroom.AddMember(m)
+	}
+	return chatroom, true
+}
+
+// SetMemberRole: admins promote or demote members below their own role.
+func SetMemberRole(c *gin.Context) {
+	username := c.GetString("username")
+	target := c.Param("username")
+	var req SetRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Log.Warn("Invalid parameter format (set role)")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
+		return
+	}
+	role := authz.Role(req.Role)
+	if !role.Valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role"})
+		return
+	}
+	chatroom, ok := withMember(c, target)
+	if !ok {
+		return
+	}
+	if !authz.CanManageMember(chatroom, username, target) || !authz.CanAssignRole(chatroom, username, role) {
+		log.Log.Warnf("set role denied: room=%s, by=%s, target=%s, role=%s", chatroom.RoomID, username, target, role)
+		c.JSON(http.StatusForbidden, gin.H{"error": "permission denied: manage roles"})
+		return
+	}
+
+	err := store.Chatrooms.SetMemberRole(chatroom.RoomID, target, string(role))
+	if errors.Is(err, store.ErrNotMember) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user is not a member of this chatroom"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("set role failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "set role failed"})
+		return
+	}
+	log.Log.Infof("member role changed: room=%s, by=%s, target=%s, role=%s", chatroom.RoomID, username, target, role)
+	ws.DefaultHub.Broadcast(ws.Event{
+		Type:   "role_changed",
+		RoomID: chatroom.RoomID,
+		Data:   ws.MemberEvent{Username: target, Role: string(role), By: username},
+	})
+	c.JSON(http.StatusOK, RoomMember{Username: target, Role: role})
+}
+
+// TransferOwnership: the owner hands the room to another member and becomes admin.
+func TransferOwnership(c *gin.Context) {
+	chatroom := middleware.Chatroom(c)
+	username := c.GetString("username")
+	var req TransferOwnershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Username == "" {
+		log.Log.Warn("Invalid parameter format (transfer ownership)")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
+		return
+	}
+	if req.Username == username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "already the owner"})
+		return
+	}
+	if _, ok := withMember(c, req.Username); !ok {
+		return
+	}
+
+	err := store.Chatrooms.TransferOwnership(chatroom.RoomID, username, req.Username)
+	if errors.Is(err, store.ErrNotMember) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user is not a member of this chatroom"})
+		return
+	}
+	if errors.Is(err, store.ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "ownership was changed by another request"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("transfer ownership failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "transfer failed"})
+		return
+	}
+	log.Log.Infof("ownership transferred: room=%s, %s -> %s", chatroom.RoomID, username, req.Username)
+	ws.DefaultHub.Broadcast(ws.Event{
+		Type:   "role_changed",
+		RoomID: chatroom.RoomID,
+		Data:   ws.MemberEvent{Username: req.Username, Role: string(authz.RoleOwner), By: username},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "ownership transferred", "owner": req.Username})
+}
+
+// KickMember removes a member with a lower role and disconnects their WebSocket clients.
+func KickMember(c *gin.Context) {
+	username := c.GetString("username")
+	target := c.Param("username")
+	chatroom, ok := withMember(c, target)
+	if !ok {
+		return
+	}
+	if !authz.CanManageMember(chatroom, username, target) {
+		log.Log.Warnf("kick denied: room=%s, by=%s, target=%s", chatroom.RoomID, username, target)
+		c.JSON(http.StatusForbidden, gin.H{"error": "permission denied: kick members"})
+		return
+	}
+
+	if err := store.Chatrooms.RemoveUserFromChatroom(target, chatroom.RoomID); err != nil {
+		log.Log.Errorf("kick member failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "kick failed"})
+		return
+	}
+	log.Log.Infof("member kicked: room=%s, by=%s, target=%s", chatroom.RoomID, username, target)
+	ws.DefaultHub.Broadcast(ws.Event{
+		Type:   ws.EventMemberRemoved,
+		RoomID: chatroom.RoomID,
+		Data:   ws.MemberEvent{Username: target, By: username},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "member removed"})
+}
@@ -0,0 +1,37 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMemberRoles(t *testing.T) {
+	api := newTestAPI(t)
+	olga, _ := api.login("olga")
+	mike, _ := api.login("mike")
+	nina, _ := api.login("nina")
+	room := api.createRoom(olga, "general", false)
+	for _, token := range []string{mike, nina} {
+		api.expect(http.StatusOK, "POST", "/api/chatrooms/join", token, map[string]any{"chatroom_id": room})
+	}
+
+	out := api.expect(http.StatusOK, "GET", "/api/chatrooms/"+room+"/members", nina, nil)
+	if members, _ := out["members"].([]any); len(members) != 3 {
+		t.Fatalf("members = %v, want 3", out["members"])
+	}
+	api.expect(http.StatusForbidden, "PUT", "/api/chatrooms/"+room+"/members/nina/role", mike, map[string]any{"role": "moderator"})
+	api.expect(http.StatusNotFound, "PUT", "/api/chatrooms/"+room+"/members/eve/role", olga, map[string]any{"role": "moderator"})
+	api.expect(http.StatusOK, "PUT", "/api/chatrooms/"+room+"/members/mike/role", olga, map[string]any{"role": "admin"})
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/members/nina/kick", mike, nil)
+	api.expect(http.StatusForbidden, "POST", "/api/messages/"+room, nina, map[string]any{"text": "still here?"})
+
+	// the owner has to hand the room over before leaving
+	api.expect(http.StatusConflict, "POST", "/api/chatrooms/exit", olga, map[string]any{"chatroom_id": room})
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/transfer", olga, map[string]any{"username": "mike"})
+	// the demoted creator keeps no owner rights
+	api.expect(http.StatusOK, "PUT", "/api/chatrooms/"+room+"/members/olga/role", mike, map[string]any{"role": "member"})
+	api.expect(http.StatusForbidden, "POST", "/api/chatrooms/"+room+"/transfer", olga, map[string]any{"username": "mike"})
+	api.expect(http.StatusForbidden, "DELETE", "/api/chatrooms/"+room, olga, nil)
+	api.expect(http.StatusForbidden, "PATCH", "/api/chatrooms/"+room, olga, map[string]any{"name": "mine"})
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/exit", olga, map[string]any{"chatroom_id": room})
+}
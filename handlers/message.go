@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"chatroom-api/authz"
+	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/models"
+	"chatroom-api/redis"
+	"chatroom-api/store"
+	"chatroom-api/utils"
+	"chatroom-api/ws"
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type PostMessageRequest struct {
+	Text          string   `json:"text"`
+	ParentID      string   `json:"parent_id"`      // optional: reply in the thread of this message
+	AttachmentIDs []string `json:"attachment_ids"` // optional: uploads of UploadAttachment, text may be empty then
+}
+
+// sendMessage persists a message and pushes it to the room's WebSocket clients.
+// With a parentID the message is a reply, store.ErrMessageNotFound if the parent does not exist.
+// Attachments are claimed from the sender's pending uploads, see claimAttachments.
+func sendMessage(roomID, sender, text, parentID string, attachmentIDs []string) (models.Message, error) {
+	msg := models.NewMessage(roomID, sender, text)
+	if parentID != "" {
+		parent, err := store.Messages.GetMessage(roomID, parentID)
+		if err != nil {
+			return msg, err
+		}
+		msg = models.NewReply(parent, sender, text)
+	}
+	attachments, err := claimAttachments(roomID, sender, attachmentIDs)
+	if err != nil {
+		return msg, err
+	}
+	msg.Attachments = attachments
+	if err := store.Messages.SaveMessage(msg); err != nil {
+		// the uploads can be sent again
+		_ = redis.RestorePendingUploads(attachments...)
+		return msg, err
+	}
+	// search index errors are logged, the message is sent anyway
+	_ = redis.IndexMessage(msg)
+	ws.DefaultHub.Broadcast(ws.Event{Type: "message", RoomID: msg.RoomID, Data: msg})
+	return msg, nil
+}
+
+func PostChatroomMessage(c *gin.Context) {
+	roomID := c.Param("roomId")
+	username := c.GetString("username")
+
+	var req PostMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Log.Warn("Invalid parameter format (post message)")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" && len(req.AttachmentIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "text is required"})
+		return
+	}
+	log.Log.Infof("Post message: user=%s, room=%s", username, roomID)
+
+	msg, err := sendMessage(roomID, username, text, req.ParentID, req.AttachmentIDs)
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "parent message not exist"})
+		return
+	}
+	if errors.Is(err, errAttachmentInvalid) || errors.Is(err, errTooManyAttachments) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("save message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "send failed"})
+		return
+	}
+	log.Log.Infof("Message posted: user=%s, room=%s, timestamp=%s", username, roomID, msg.Timestamp)
+	msgs := []models.Message{msg}
+	signAttachments(msgs, username)
+	c.JSON(http.StatusOK, msgs[0])
+}
+
+type EditMessageRequest struct {
+	Text string `json:"text"`
+}
+
+// changeableMessage loads :messageId for an edit or delete. Senders change their own
+// messages, moderators anyone's. It writes the error response and returns false otherwise.
+func changeableMessage(c *gin.Context) (models.Message, bool) {
+	chatroom := middleware.Chatroom(c)
+	username := c.GetString("username")
+	messageID := c.Param("messageId")
+
+	msg, err := store.Messages.GetMessage(chatroom.RoomID, messageID)
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+		return msg, false
+	}
+	if err != nil {
+		log.Log.Errorf("query message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return msg, false
+	}
+	if msg.Sender != username && !authz.Can(username, chatroom, authz.ModerateMessages) {
+		log.Log.Warnf("change message denied: room=%s, message=%s, user=%s", chatroom.RoomID, messageID, username)
+		c.JSON(http.StatusForbidden, gin.H{"error": "permission denied: moderate messages"})
+		return msg, false
+	}
+	if msg.Deleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "message was deleted"})
+		return msg, false
+	}
+	return msg, true
+}
+
+// messageChangeFailed writes the response for an EditMessage / DeleteMessage error.
+func messageChangeFailed(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, store.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+	case errors.Is(err, store.ErrConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "message was changed by another request"})
+	default:
+		log.Log.Errorf("change message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "update failed"})
+	}
+}
+
+func EditChatroomMessage(c *gin.Context) {
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Log.Warn("Invalid parameter format (edit message)")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
+		return
+	}
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "text is required"})
+		return
+	}
+	msg, ok := changeableMessage(c)
+	if !ok {
+		return
+	}
+	username := c.GetString("username")
+	if text == msg.Text {
+		c.JSON(http.StatusOK, msg)
+		return
+	}
+
+	old := msg
+	msg, err := store.Messages.EditMessage(msg, text, username)
+	if err != nil {
+		messageChangeFailed(c, err)
+		return
+	}
+	_ = redis.ReindexMessage(old, msg)
+	log.Log.Infof("message edited: room=%s, message=%s, by=%s", msg.RoomID, msg.MessageID, username)
+	ws.DefaultHub.Broadcast(ws.Event{Type: "message_edited", RoomID: msg.RoomID, Data: msg})
+	c.JSON(http.StatusOK, msg)
+}
+
+// DeleteChatroomMessage leaves a tombstone in the history.
+func DeleteChatroomMessage(c *gin.Context) {
+	msg, ok := changeableMessage(c)
+	if !ok {
+		return
+	}
+	username := c.GetString("username")
+
+	old := msg
+	msg, err := store.Messages.DeleteMessage(msg, username)
+	if err != nil {
+		messageChangeFailed(c, err)
+		return
+	}
+	_ = redis.ReindexMessage(old, msg)
+	deleteAttachmentBlobs(old.Attachments)
+	log.Log.Infof("message deleted: room=%s, message=%s, by=%s", msg.RoomID, msg.MessageID, username)
+	ws.DefaultHub.Broadcast(ws.Event{Type: "message_deleted", RoomID: msg.RoomID, Data: msg})
+	c.JSON(http.StatusOK, msg)
+}
+
+// GetMessageRevisions: previous versions of a message, for moderators.
+func GetMessageRevisions(c *gin.Context) {
+	roomID := c.Param("roomId")
+	messageID := c.Param("messageId")
+	revs, err := store.Messages.ListMessageRevisions(roomID, messageID)
+	if err != nil {
+		log.Log.Errorf("query message revisions failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if revs == nil {
+		revs = []models.MessageRevision{}
+	}
+	c.JSON(http.StatusOK, gin.H{"message_id": messageID, "revisions": revs})
+}
+
+type threadHistory struct {
+	Root models.Message `json:"root"`
+	messageHistory
+}
+
+// GetThreadMessages: GET /messages/:roomId/:messageId/thread pages through the replies of a
+// thread with the same parameters and cursors as the room history. Any message of the
+// thread can be given, the root is returned alongside the replies.
+func GetThreadMessages(c *gin.Context) {
+	roomID := c.Param("roomId")
+	root, err := store.Messages.GetMessage(roomID, c.Param("messageId"))
+	if err == nil && root.ThreadRootID != "" {
+		root, err = store.Messages.GetMessage(roomID, root.ThreadRootID)
+	}
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("query message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+
+	res, ok := queryMessageHistory(c, store.MessageQuery{RoomID: roomID, ThreadRootID: root.MessageID})
+	if !ok {
+		return
+	}
+	roots := []models.Message{root}
+	if err := attachReactions(roots, c.GetString("username")); err != nil {
+		log.Log.Errorf("query reactions failed: %v", err)
+	}
+	signAttachments(roots, c.GetString("username"))
+	root = roots[0]
+	log.Log.Infof("Find %d replies: room=%s, thread=%s", len(res.Messages), roomID, root.MessageID)
+	c.JSON(http.StatusOK, threadHistory{Root: root, messageHistory: res})
+}
+
+const maxMessagePageSize = 100
+
+type messageHistory struct {
+	Messages   []models.Message `json:"messages"`
+	HasMore    bool             `json:"has_more"`
+	NextCursor string           `json:"next_cursor,omitempty"` // older messages
+	PrevCursor string           `json:"prev_cursor,omitempty"` // newer messages
+}
+
+// Cursors are opaque to clients: base64url("b:<message_id>") for older, "a:<message_id>" for newer.
+func encodeMessageCursor(forward bool, messageID string) string {
+	if messageID == "" {
+		return ""
+	}
+	dir := "b:"
+	if forward {
+		dir = "a:"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(dir + messageID))
+}
+
+func decodeMessageCursor(cursor string) (forward bool, messageID string, ok bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) < 3 {
+		return false, "", false
+	}
+	switch string(raw[:2]) {
+	case "a:":
+		return true, string(raw[2:]), true
+	case "b:":
+		return false, string(raw[2:]), true
+	}
+	return false, "", false
+}
+
+// parseMessageBound accepts a message_id, or an RFC3339 timestamp from older clients.
+func parseMessageBound(v string) string {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return utils.ULIDLowerBound(t)
+	}
+	return v
+}
+
+func reverseMessages(msgs []models.Message) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
+
+func newMessageHistory(msgs []models.Message) messageHistory {
+	if msgs == nil {
+		msgs = []models.Message{}
+	}
+	return messageHistory{Messages: msgs}
+}
+
+// The helpers below page through base, a store.MessageQuery with RoomID (and ThreadRootID) set.
+
+func messagesBefore(base store.MessageQuery, before string, limit int) (messageHistory, error) {
+	q := base
+	q.Cursor, q.Limit = before, limit
+	page, err := store.Messages.QueryMessages(q)
+	if err != nil {
+		return messageHistory{}, err
+	}
+	res := newMessageHistory(page.Messages)
+	res.HasMore = page.LastKey != ""
+	res.NextCursor = encodeMessageCursor(false, page.LastKey)
+	// started below an upper bound, so newer messages exist
+	if before != "" && len(page.Messages) > 0 {
+		res.PrevCursor = encodeMessageCursor(true, page.Messages[0].MessageID)
+	}
+	return res, nil
+}
+
+func messagesAfter(base store.MessageQuery, after string, limit int) (messageHistory, error) {
+	q := base
+	q.Cursor, q.Forward, q.Limit = after, true, limit
+	page, err := store.Messages.QueryMessages(q)
+	if err != nil {
+		return messageHistory{}, err
+	}
+	reverseMessages(page.Messages)
+	res := newMessageHistory(page.Messages)
+	res.HasMore = page.LastKey != ""
+	res.PrevCursor = encodeMessageCursor(true, page.LastKey)
+	if len(page.Messages) > 0 {
+		res.NextCursor = encodeMessageCursor(false, page.Messages[len(page.Messages)-1].MessageID)
+	}
+	return res, nil
+}
+
+// messagesAround returns the target message with up to limit/2 older messages and the rest newer.
+func messagesAround(base store.MessageQuery, messageID string, limit int) (messageHistory, error) {
+	olderLimit := limit / 2
+	if olderLimit == 0 {
+		olderLimit = 1
+	}
+	q := base
+	q.Cursor, q.Forward, q.Inclusive, q.Limit = messageID, true, true, max(limit-olderLimit, 1)
+	newer, err := store.Messages.QueryMessages(q)
+	if err != nil {
+		return messageHistory{}, err
+	}
+	q = base
+	q.Cursor, q.Limit = messageID, olderLimit
+	older, err := store.Messages.QueryMessages(q)
+	if err != nil {
+		return messageHistory{}, err
+	}
+	reverseMessages(newer.Messages)
+	res := newMessageHistory(append(newer.Messages, older.Messages...))
+	res.HasMore = newer.LastKey != "" || older.LastKey != ""
+	res.NextCursor = encodeMessageCursor(false, older.LastKey)
+	res.PrevCursor = encodeMessageCursor(true, newer.LastKey)
+	return res, nil
+}
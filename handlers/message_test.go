@@ -0,0 +1,21 @@
+package handlers
+
+import "testing"
+
+func TestMessageCursorRoundTrip(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		cursor := encodeMessageCursor(forward, "01HZY0000000000000000000AB")
+		gotForward, id, ok := decodeMessageCursor(cursor)
+		if !ok || gotForward != forward || id != "01HZY0000000000000000000AB" {
+			t.Fatalf("decode(encode(%v)) = %v, %q, %v", forward, gotForward, id, ok)
+		}
+	}
+	if encodeMessageCursor(false, "") != "" {
+		t.Fatal("an empty message id must give no cursor")
+	}
+	for _, bad := range []string{"", "!!", "eDox", "Yjo"} { // invalid base64, "x:1", "b:"
+		if _, _, ok := decodeMessageCursor(bad); ok {
+			t.Errorf("decodeMessageCursor(%q) accepted", bad)
+		}
+	}
+}
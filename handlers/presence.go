@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/redis"
+	"chatroom-api/store"
+	"chatroom-api/ws"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type PresenceEvent struct {
+	Username string `json:"username"`
+	Status   string `json:"status"` // online, away or offline
+}
+
+type TypingEvent struct {
+	Username string `json:"username"`
+	Typing   bool   `json:"typing"`
+	// clients drop the indicator after this many seconds without a new event
+	ExpiresIn int `json:"expires_in,omitempty"`
+}
+
+// typing indicators last a bit longer than the throttle, so a user who keeps typing never flickers
+var typingExpiresIn = int(2 * redis.TypingThrottle.Seconds())
+
+// wsHandlers wires WebSocket connections to presence: a connection counts as online
+// from open to close and its entry is refreshed on every pong and heartbeat frame.
+var wsHandlers = ws.Handlers{
+	OnOpen: func(c *ws.Client) {
+		setPresence(c, redis.StatusOnline)
+	},
+	OnMessage: handleWSMessage,
+	OnPong: func(c *ws.Client) {
+		setPresence(c, c.Status())
+	},
+	OnClose: func(c *ws.Client) {
+		before, after, err := redis.RemovePresence(c.Username, c.ID)
+		if err == nil && before != after {
+			broadcastPresence(c.Username, after)
+		}
+	},
+}
+
+func setPresence(c *ws.Client, status string) {
+	c.SetStatus(status)
+	before, after, err := redis.SetPresence(c.Username, c.ID, status)
+	if err == nil && before != after {
+		broadcastPresence(c.Username, after)
+	}
+}
+
+// broadcastPresence pushes a status change to every room of the user.
+func broadcastPresence(username, status string) {
+	rooms, err := store.Chatrooms.GetChatroomsByUsername(username)
+	if err != nil {
+		log.Log.Errorf("presence broadcast failed: user=%s, err=%v", username, err)
+		return
+	}
+	log.Log.Infof("presence changed: user=%s, status=%s, rooms=%d", username, status, len(rooms))
+	for _, room := range rooms {
+		ws.DefaultHub.Broadcast(ws.Event{
+			Type:   "presence",
+			RoomID: room.RoomID,
+			Data:   PresenceEvent{Username: username, Status: status},
+		})
+	}
+}
+
+// presenceSweepInterval: how often connections that died without closing are looked for,
+// they are reported offline at most this long after their entry expired.
+const presenceSweepInterval = redis.PresenceTTL / 3
+
+// StartPresenceSweeper periodically reports users offline whose connections all died without
+// closing (crashed instance, lost network), see redis.SweepPresence.
+func StartPresenceSweeper() {
+	go func() {
+		ticker := time.NewTicker(presenceSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepPresence()
+		}
+	}()
+}
+
+// maxPresenceSweep bounds the users handled per sweep, the rest wait for the next one.
+const maxPresenceSweep = 1000
+
+func sweepPresence() {
+	// on errors the users found so far are still reported
+	users, _ := redis.SweepPresence(maxPresenceSweep)
+	for _, u := range users {
+		broadcastPresence(u, redis.StatusOffline)
+	}
+}
+
+// sendTyping broadcasts a typing indicator, start events at most once per throttle period.
+// Like messages, indicators are only sent by members.
+func sendTyping(c *ws.Client, typing bool) {
+	event := TypingEvent{Username: c.Username}
+	if typing {
+		ok, err := redis.StartTyping(c.RoomID, c.Username)
+		if err != nil {
+			log.Log.Errorf("start typing failed: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		event.Typing, event.ExpiresIn = true, typingExpiresIn
+	} else if err := redis.StopTyping(c.RoomID, c.Username); err != nil {
+		log.Log.Errorf("stop typing failed: %v", err)
+	}
+	if !canPostWS(c) {
+		return
+	}
+	ws.DefaultHub.Broadcast(ws.Event{Type: "typing", RoomID: c.RoomID, Data: event})
+}
+
+// sharesRoom reports whether a and b are members of a common room.
+func sharesRoom(a, b string) (bool, error) {
+	if a == b {
+		return true, nil
+	}
+	rooms, err := store.Chatrooms.GetChatroomsByUsername(a)
+	if err != nil {
+		return false, err
+	}
+	mine := make(map[string]bool, len(rooms))
+	for _, room := range rooms {
+		mine[room.RoomID] = true
+	}
+	rooms, err = store.Chatrooms.GetChatroomsByUsername(b)
+	if err != nil {
+		return false, err
+	}
+	for _, room := range rooms {
+		if mine[room.RoomID] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetUserPresence: GET /users/:username/presence, only for users who share a room with the caller.
+func GetUserPresence(c *gin.Context) {
+	username := c.Param("username")
+	shared, err := sharesRoom(c.GetString("username"), username)
+	if err != nil {
+		log.Log.Errorf("query chatrooms failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	if !shared {
+		c.JSON(http.StatusForbidden, gin.H{"error": "can only see the presence of users who share a chatroom with you"})
+		return
+	}
+	statuses, err := redis.GetPresence([]string{username})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	c.JSON(http.StatusOK, PresenceEvent{Username: username, Status: statuses[username]})
+}
+
+// GetOnlineMembers: GET /chatrooms/:roomId/online lists the members that are online or away.
+func GetOnlineMembers(c *gin.Context) {
+	chatroom := middleware.Chatroom(c)
+	members, err := store.Chatrooms.ListMembers(chatroom.RoomID)
+	if err != nil {
+		log.Log.Errorf("query members failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	usernames := make([]string, 0, len(members))
+	for _, m := range members {
+		usernames = append(usernames, m.Username)
+	}
+	statuses, err := redis.GetPresence(usernames)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	online := []PresenceEvent{}
+	for u, status := range statuses {
+		if status != redis.StatusOffline {
+			online = append(online, PresenceEvent{Username: u, Status: status})
+		}
+	}
+	sort.Slice(online, func(i, j int) bool { return online[i].Username < online[j].Username })
+	c.JSON(http.StatusOK, gin.H{"room_id": chatroom.RoomID, "online": online})
+}
@@ -0,0 +1,33 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserPresenceVisibility(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	carol, _ := api.login("carol")
+	room := api.createRoom(alice, "general", false)
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, map[string]any{"chatroom_id": room})
+
+	api.dial(room, bob)
+	// the dial returns before the server has stored the connection
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		out := api.expect(http.StatusOK, "GET", "/api/users/bob/presence", alice, nil)
+		if out["status"] == "online" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bob = %v, want online", out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	api.expect(http.StatusOK, "GET", "/api/users/carol/presence", carol, nil)
+	api.expect(http.StatusForbidden, "GET", "/api/users/bob/presence", carol, nil)
+	api.expect(http.StatusForbidden, "GET", "/api/users/nobody/presence", alice, nil)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"chatroom-api/ws"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxEmojiLength = 32
+
+type ReactionEvent struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Username  string `json:"username"`
+}
+
+type reactionResponse struct {
+	MessageID string                   `json:"message_id"`
+	Reactions []models.ReactionSummary `json:"reactions"`
+}
+
+// validEmoji: '#' separates the parts of the reaction key.
+func validEmoji(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxEmojiLength && !strings.ContainsAny(emoji, "# \t\n")
+}
+
+// attachReactions fills the reaction summaries of msgs, seen by username.
+func attachReactions(msgs []models.Message, username string) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]string, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.MessageID
+	}
+	reactions, err := store.Reactions.ListReactions(msgs[0].RoomID, ids)
+	if err != nil {
+		return err
+	}
+	summaries := models.SummarizeReactions(reactions, username)
+	for i := range msgs {
+		msgs[i].Reactions = summaries[msgs[i].MessageID]
+	}
+	return nil
+}
+
+// reactionTarget validates :emoji and loads :messageId. It writes the error response and returns false otherwise.
+func reactionTarget(c *gin.Context) (models.Message, string, bool) {
+	chatroom := middleware.Chatroom(c)
+	emoji := c.Param("emoji")
+	if !validEmoji(emoji) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid emoji"})
+		return models.Message{}, "", false
+	}
+	msg, err := store.Messages.GetMessage(chatroom.RoomID, c.Param("messageId"))
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+		return msg, "", false
+	}
+	if err != nil {
+		log.Log.Errorf("query message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return msg, "", false
+	}
+	return msg, emoji, true
+}
+
+// respondReactions answers with the current summaries of msg.
+func respondReactions(c *gin.Context, msg models.Message) {
+	msgs := []models.Message{msg}
+	if err := attachReactions(msgs, c.GetString("username")); err != nil {
+		log.Log.Errorf("query reactions failed: %v", err)
+	}
+	res := reactionResponse{MessageID: msg.MessageID, Reactions: msgs[0].Reactions}
+	if res.Reactions == nil {
+		res.Reactions = []models.ReactionSummary{}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// AddReaction: PUT /messages/:roomId/:messageId/reactions/:emoji, reacting twice is a no-op.
+func AddReaction(c *gin.Context) {
+	msg, emoji, ok := reactionTarget(c)
+	if !ok {
+		return
+	}
+	if msg.Deleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "message was deleted"})
+		return
+	}
+	username := c.GetString("username")
+
+	r := models.NewReaction(msg.RoomID, msg.MessageID, emoji, username, time.Now().Format(time.RFC3339))
+	added, err := store.Reactions.AddReaction(r)
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("add reaction failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "add reaction failed"})
+		return
+	}
+	// clients already got the event of the first reaction
+	if added {
+		log.Log.Infof("reaction added: room=%s, message=%s, user=%s, emoji=%s", msg.RoomID, msg.MessageID, username, emoji)
+		ws.DefaultHub.Broadcast(ws.Event{
+			Type:   "reaction_added",
+			RoomID: msg.RoomID,
+			Data:   ReactionEvent{MessageID: msg.MessageID, Emoji: emoji, Username: username},
+		})
+	}
+	respondReactions(c, msg)
+}
+
+func RemoveReaction(c *gin.Context) {
+	msg, emoji, ok := reactionTarget(c)
+	if !ok {
+		return
+	}
+	username := c.GetString("username")
+
+	removed, err := store.Reactions.RemoveReaction(msg.RoomID, msg.MessageID, emoji, username)
+	if err != nil {
+		log.Log.Errorf("remove reaction failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "remove reaction failed"})
+		return
+	}
+	if removed {
+		log.Log.Infof("reaction removed: room=%s, message=%s, user=%s, emoji=%s", msg.RoomID, msg.MessageID, username, emoji)
+		ws.DefaultHub.Broadcast(ws.Event{
+			Type:   "reaction_removed",
+			RoomID: msg.RoomID,
+			Data:   ReactionEvent{MessageID: msg.MessageID, Emoji: emoji, Username: username},
+		})
+	}
+	respondReactions(c, msg)
+}
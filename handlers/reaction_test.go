@@ -0,0 +1,83 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextReactionEvent returns the type of the next reaction event.
+func nextReactionEvent(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for a reaction event: %v", err)
+		}
+		var ev struct{ Type string }
+		_ = json.Unmarshal(data, &ev)
+		if strings.HasPrefix(ev.Type, "reaction_") {
+			return ev.Type
+		}
+	}
+}
+
+func reactionsOf(msg map[string]any) []any {
+	list, _ := msg["reactions"].([]any)
+	return list
+}
+
+func TestReactions(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	room := api.createRoom(alice, "general", false)
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, map[string]any{"chatroom_id": room})
+	msg := api.post(alice, room, "hello")["message_id"].(string)
+	reactions := "/api/messages/" + room + "/" + msg + "/reactions/"
+	conn := api.dial(room, alice)
+
+	api.expect(http.StatusBadRequest, "PUT", reactions+url.PathEscape("a#b"), bob, nil)
+	api.expect(http.StatusBadRequest, "PUT", reactions+strings.Repeat("x", 33), bob, nil)
+	api.expect(http.StatusNotFound, "PUT", "/api/messages/"+room+"/nope/reactions/ok", bob, nil)
+
+	thumb := reactions + url.PathEscape("👍")
+	api.expect(http.StatusOK, "PUT", thumb, bob, nil)
+	out := api.expect(http.StatusOK, "PUT", thumb, bob, nil)
+	summary, _ := reactionsOf(out)[0].(map[string]any)
+	if summary["count"] != float64(1) || summary["reacted"] != true {
+		t.Fatalf("summary after reacting twice = %v, want count 1, reacted", summary)
+	}
+	api.expect(http.StatusOK, "DELETE", thumb, bob, nil)
+	api.expect(http.StatusOK, "DELETE", thumb, bob, nil)
+	api.expect(http.StatusOK, "PUT", thumb, alice, nil)
+	// repeated requests change nothing and are not broadcast again
+	for _, want := range []string{"reaction_added", "reaction_removed", "reaction_added"} {
+		if got := nextReactionEvent(t, conn); got != want {
+			t.Fatalf("event = %s, want %s", got, want)
+		}
+	}
+
+	// a reply between the thread root and a newer message keeps its own reactions
+	reply := api.expect(http.StatusOK, "POST", "/api/messages/"+room, bob, map[string]any{"text": "re", "parent_id": msg})["message_id"].(string)
+	api.post(alice, room, "later")
+	api.expect(http.StatusOK, "PUT", "/api/messages/"+room+"/"+reply+"/reactions/ok", alice, nil)
+	for _, m := range messagesOf(api.expect(http.StatusOK, "GET", "/api/messages/"+room, bob, nil)) {
+		want := 0
+		if m["message_id"] == msg {
+			want = 1
+		}
+		if got := len(reactionsOf(m)); got != want {
+			t.Fatalf("timeline message %v has %d reactions, want %d", m["text"], got, want)
+		}
+	}
+	thread := api.expect(http.StatusOK, "GET", "/api/messages/"+room+"/"+msg+"/thread", bob, nil)
+	if replies := messagesOf(thread); len(replies) != 1 || len(reactionsOf(replies[0])) != 1 {
+		t.Fatalf("thread = %v, want one reply with one reaction", replies)
+	}
+}
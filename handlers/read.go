@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"chatroom-api/utils"
+	"chatroom-api/ws"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// unread counts stop here, see roomActivity.UnreadCapped
+const maxUnreadCount = 100
+
+const previewLength = 100
+
+type MarkReadRequest struct {
+	MessageID string `json:"message_id"` // default: the latest message
+}
+
+type ReadEvent struct {
+	Username  string `json:"username"`
+	MessageID string `json:"message_id"`
+}
+
+type messagePreview struct {
+	MessageID string `json:"message_id"`
+	Sender    string `json:"sender"`
+	Text      string `json:"text"`
+	Timestamp string `json:"timestamp"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	// Attachments is the number of attached files, the text may be empty
+	Attachments int `json:"attachments,omitempty"`
+}
+
+type roomActivity struct {
+	Unread int
+	// UnreadCapped: counting stopped early, clients show Unread as "n+"
+	UnreadCapped bool
+	LastMessage  *messagePreview
+}
+
+func newMessagePreview(msg models.Message) *messagePreview {
+	text := msg.Text
+	if utf8.RuneCountInString(text) > previewLength {
+		text = string([]rune(text)[:previewLength]) + "…"
+	}
+	return &messagePreview{
+		MessageID:   msg.MessageID,
+		Sender:      msg.Sender,
+		Text:        text,
+		Timestamp:   msg.Timestamp,
+		Deleted:     msg.Deleted,
+		Attachments: len(msg.Attachments),
+	}
+}
+
+// maxActivityQueries bounds the rooms loadRoomActivity reads at the same time.
+const maxActivityQueries = 8
+
+// loadRoomActivity reads the last message and the unread count of each room for username,
+// up to maxActivityQueries rooms in parallel. Failures are logged and leave the room without activity.
+func loadRoomActivity(rooms []models.Chatroom, username string) []roomActivity {
+	res := make([]roomActivity, len(rooms))
+	sem := make(chan struct{}, maxActivityQueries)
+	var wg sync.WaitGroup
+	for i, room := range rooms {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, room models.Chatroom) {
+			defer func() { <-sem; wg.Done() }()
+			page, err := store.Messages.QueryMessages(store.MessageQuery{RoomID: room.RoomID, Limit: 1})
+			if err != nil {
+				log.Log.Errorf("query last message failed: room=%s, %v", room.RoomID, err)
+				return
+			}
+			if len(page.Messages) == 0 {
+				return
+			}
+			res[i].LastMessage = newMessagePreview(page.Messages[0])
+			res[i].Unread, res[i].UnreadCapped, err = store.Messages.CountUnread(room.RoomID, unreadAfter(room, username), username, maxUnreadCount)
+			if err != nil {
+				log.Log.Errorf("count unread failed: room=%s, %v", room.RoomID, err)
+			}
+		}(i, room)
+	}
+	wg.Wait()
+	return res
+}
+
+// unreadAfter is the message_id unread messages of username follow: the read receipt, or
+// the time the user joined if they never marked anything read.
+func unreadAfter(room models.Chatroom, username string) string {
+	if id := room.LastRead[username]; id != "" {
+		return id
+	}
+	joined, err := time.Parse(time.RFC3339, room.JoinedAt[username])
+	if err != nil {
+		return ""
+	}
+	return utils.ULIDLowerBound(joined)
+}
+
+// MarkChatroomRead: POST /chatrooms/:roomId/read moves the caller's read receipt to a message.
+// Receipts never move back, marking an older message is accepted and changes nothing.
+func MarkChatroomRead(c *gin.Context) {
+	chatroom := middleware.Chatroom(c)
+	username := c.GetString("username")
+	var req MarkReadRequest
+	// the body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Log.Warn("Invalid parameter format (mark read)")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid parameter format"})
+			return
+		}
+	}
+
+	var msg models.Message
+	var err error
+	if req.MessageID == "" {
+		var page store.MessagePage
+		page, err = store.Messages.QueryMessages(store.MessageQuery{RoomID: chatroom.RoomID, Limit: 1})
+		if err == nil && len(page.Messages) == 0 {
+			c.JSON(http.StatusOK, gin.H{"last_read_id": ""})
+			return
+		}
+		if err == nil {
+			msg = page.Messages[0]
+		}
+	} else {
+		msg, err = store.Messages.GetMessage(chatroom.RoomID, req.MessageID)
+	}
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("query message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+
+	err = store.Chatrooms.MarkRead(chatroom.RoomID, username, msg.MessageID)
+	if errors.Is(err, store.ErrNotMember) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "not a member of this chatroom"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("mark read failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "mark read failed"})
+		return
+	}
+	lastRead := msg.MessageID
+	if prev := chatroom.LastRead[username]; prev > lastRead {
+		lastRead = prev
+	} else if prev != lastRead {
+		ws.DefaultHub.Broadcast(ws.Event{
+			Type:   "read",
+			RoomID: chatroom.RoomID,
+			Data:   ReadEvent{Username: username, MessageID: lastRead},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"last_read_id": lastRead})
+}
+
+// GetMessageReaders: GET /chatrooms/:roomId/read/:messageId lists the members who have
+// read up to the message (their receipt is the message or a newer one).
+func GetMessageReaders(c *gin.Context) {
+	chatroom := middleware.Chatroom(c)
+	messageID := c.Param("messageId")
+	msg, err := store.Messages.GetMessage(chatroom.RoomID, messageID)
+	if errors.Is(err, store.ErrMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not exist"})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("query message failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+
+	members, err := store.Chatrooms.ListMembers(chatroom.RoomID)
+	if err != nil {
+		log.Log.Errorf("query members failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	readBy := []ReadEvent{}
+	for _, m := range members {
+		if m.LastReadID >= msg.MessageID {
+			readBy = append(readBy, ReadEvent{Username: m.Username, MessageID: m.LastReadID})
+		}
+	}
+	sort.Slice(readBy, func(i, j int) bool { return readBy[i].Username < readBy[j].Username })
+	c.JSON(http.StatusOK, gin.H{"message_id": msg.MessageID, "read_by": readBy})
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"chatroom-api/models"
+	"chatroom-api/utils"
+	"testing"
+	"time"
+)
+
+func TestUnreadAfter(t *testing.T) {
+	joined := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	room := models.Chatroom{}
+	room.AddMember(models.Member{Username: "bob", JoinedAt: joined.Format(time.RFC3339)})
+	if got, want := unreadAfter(room, "bob"), utils.ULIDLowerBound(joined); got != want {
+		t.Fatalf("never read: unreadAfter = %q, want the join time %q", got, want)
+	}
+	room.AddMember(models.Member{Username: "alice", LastReadID: "01ABC"})
+	if got := unreadAfter(room, "alice"); got != "01ABC" {
+		t.Fatalf("read receipt: unreadAfter = %q, want 01ABC", got)
+	}
+	if got := unreadAfter(room, "carol"); got != "" {
+		t.Fatalf("unknown join time: unreadAfter = %q, want everything", got)
+	}
+}
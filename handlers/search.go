@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/redis"
+	"chatroom-api/store"
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxSearchPageSize = 50
+
+// backfillPageSize: messages read and indexed per round trip by BackfillSearchIndex
+const backfillPageSize = 100
+
+type searchResult struct {
+	models.Message
+	RoomName string `json:"room_name,omitempty"`
+}
+
+// parseSearchTime accepts RFC3339 or a date; a date as upper bound includes the whole day.
+func parseSearchTime(v string, end bool) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Millisecond)
+	}
+	return t, true
+}
+
+// SearchMessages: GET /search/messages?q=&room_id=&sender=&from=&to=&limit=&cursor=
+// Every word of q must match. Only rooms the caller is a member of are searched,
+// results are newest first.
+func SearchMessages(c *gin.Context) {
+	username := c.GetString("username")
+	tokens := redis.QueryTokens(c.Query("q"))
+	if len(tokens) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	from, okFrom := parseSearchTime(c.Query("from"), false)
+	to, okTo := parseSearchTime(c.Query("to"), true)
+	if !okFrom || !okTo {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be RFC3339 times or dates"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > maxSearchPageSize {
+		limit = maxSearchPageSize
+	}
+	var after string
+	if cursor := c.Query("cursor"); cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		after = string(raw)
+	}
+
+	rooms, err := store.Chatrooms.GetChatroomsByUsername(username)
+	if err != nil {
+		log.Log.Errorf("Failed to query chatroom list: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	names := make(map[string]string, len(rooms))
+	var roomIDs []string
+	for _, room := range rooms {
+		names[room.RoomID] = room.Name
+		roomIDs = append(roomIDs, room.RoomID)
+	}
+	if roomID := c.Query("room_id"); roomID != "" {
+		if _, ok := names[roomID]; !ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not a member of this chatroom"})
+			return
+		}
+		roomIDs = []string{roomID}
+	}
+
+	hits, more, err := redis.SearchMessages(redis.SearchQuery{
+		RoomIDs: roomIDs,
+		Tokens:  tokens,
+		Sender:  c.Query("sender"),
+		From:    from,
+		To:      to,
+		After:   after,
+		Limit:   limit,
+	})
+	if errors.Is(err, redis.ErrSearchCursorInvalid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "search failed"})
+		return
+	}
+
+	// the index only holds ids, messages are loaded in parallel
+	msgs := make([]*models.Message, len(hits))
+	var wg sync.WaitGroup
+	for i, hit := range hits {
+		wg.Add(1)
+		go func(i int, hit redis.SearchHit) {
+			defer wg.Done()
+			msg, err := store.Messages.GetMessage(hit.RoomID, hit.MessageID)
+			if err != nil {
+				if !errors.Is(err, store.ErrMessageNotFound) {
+					log.Log.Errorf("load search hit failed: room=%s, message=%s, err=%v", hit.RoomID, hit.MessageID, err)
+				}
+				return
+			}
+			msgs[i] = &msg
+		}(i, hit)
+	}
+	wg.Wait()
+
+	results := []searchResult{}
+	for _, msg := range msgs {
+		if msg != nil && !msg.Deleted {
+			signed := []models.Message{*msg}
+			signAttachments(signed, username)
+			results = append(results, searchResult{Message: signed[0], RoomName: names[msg.RoomID]})
+		}
+	}
+	res := gin.H{"results": results, "has_more": more}
+	if more {
+		res["next_cursor"] = base64.RawURLEncoding.EncodeToString([]byte(hits[len(hits)-1].Cursor()))
+	}
+	log.Log.Infof("search: user=%s, rooms=%d, tokens=%d, results=%d", username, len(roomIDs), len(tokens), len(results))
+	c.JSON(http.StatusOK, res)
+}
+
+// BackfillSearchIndex indexes the stored messages of a room, thread replies included: those
+// sent before the search index existed or lost with Redis. It returns the number of messages read.
+func BackfillSearchIndex(roomID string) (int, error) {
+	var roots []string
+	n, err := backfillMessages(store.MessageQuery{RoomID: roomID}, func(m models.Message) {
+		if m.ReplyCount > 0 {
+			roots = append(roots, m.MessageID)
+		}
+	})
+	if err != nil {
+		return n, err
+	}
+	for _, root := range roots {
+		replies, err := backfillMessages(store.MessageQuery{RoomID: roomID, ThreadRootID: root}, nil)
+		n += replies
+		if err != nil {
+			return n, err
+		}
+	}
+	log.Log.Infof("search index backfilled: room=%s, messages=%d", roomID, n)
+	return n, nil
+}
+
+// backfillMessages pages through q oldest first, indexing each page. visit, if set, sees every message.
+func backfillMessages(q store.MessageQuery, visit func(models.Message)) (int, error) {
+	q.Forward, q.Limit = true, backfillPageSize
+	n := 0
+	for {
+		page, err := store.Messages.QueryMessages(q)
+		if err != nil {
+			return n, err
+		}
+		indexed, err := redis.IndexMessages(page.Messages)
+		n += indexed
+		if err != nil {
+			return n, err
+		}
+		if visit != nil {
+			for _, m := range page.Messages {
+				visit(m)
+			}
+		}
+		if page.LastKey == "" {
+			return n, nil
+		}
+		q.Cursor = page.LastKey
+	}
+}
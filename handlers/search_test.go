@@ -0,0 +1,50 @@
+package handlers_test
+
+import (
+	"chatroom-api/handlers"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func (api *testAPI) search(token, q string) []map[string]any {
+	api.t.Helper()
+	var hits []map[string]any
+	out := api.expect(http.StatusOK, "GET", "/api/search/messages?q="+q, token, nil)
+	results, _ := out["results"].([]any)
+	for _, r := range results {
+		hits = append(hits, r.(map[string]any))
+	}
+	return hits
+}
+
+func TestBackfillSearchIndex(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	room := api.createRoom(alice, "general", false)
+	root := api.post(alice, room, "deploy today")["message_id"].(string)
+	api.expect(http.StatusOK, "POST", "/api/messages/"+room, alice, map[string]any{"text": "deploy done", "parent_id": root})
+	gone := api.post(alice, room, "deploy secret")["message_id"].(string)
+	api.expect(http.StatusOK, "DELETE", "/api/messages/"+room+"/"+gone, alice, nil)
+
+	// messages written before the index existed
+	for _, key := range api.mr.Keys() {
+		if strings.HasPrefix(key, "search:") {
+			api.mr.Del(key)
+		}
+	}
+	if hits := api.search(alice, "deploy"); len(hits) != 0 {
+		t.Fatalf("hits before backfill = %v, want none", hits)
+	}
+	n, err := handlers.BackfillSearchIndex(room)
+	if err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("backfill indexed %d messages, want 2", n)
+	}
+	hits := api.search(alice, "deploy")
+	if len(hits) != 2 || hits[0]["text"] != "deploy done" || hits[1]["text"] != "deploy today" {
+		t.Fatalf("hits = %v, want the reply and the root", hits)
+	}
+}
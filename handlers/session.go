@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/middleware"
+	"chatroom-api/redis"
+	"chatroom-api/utils"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens creates a new access token and refresh token for the session. A refresh
+// only rotates the tokens of a session that still exists, see redis.RotateSession.
+func issueTokens(username, sessionID string, refresh bool) (string, string, error) {
+	token, err := utils.GenerateToken(username, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	save := redis.SaveSession
+	if refresh {
+		save = redis.RotateSession
+	}
+	if err := save(username, sessionID, token, utils.AccessTokenTTL); err != nil {
+		return "", "", err
+	}
+	refreshToken := redis.NewRefreshToken()
+	if err := redis.SaveRefreshToken(username, sessionID, refreshToken); err != nil {
+		return "", "", err
+	}
+	return token, refreshToken, nil
+}
+
+func RefreshToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong request format"})
+		return
+	}
+
+	username, sessionID, err := redis.ConsumeRefreshToken(req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, redis.ErrRefreshTokenInvalid) || errors.Is(err, redis.ErrRefreshTokenReused) {
+			log.Log.Warnf("refresh token rejected: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		log.Log.Errorf("refresh token check failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "refresh failed"})
+		return
+	}
+
+	token, refreshToken, err := issueTokens(username, sessionID, true)
+	if errors.Is(err, redis.ErrRefreshTokenInvalid) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Log.Errorf("Token generated failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generated failed"})
+		return
+	}
+	log.Log.Infof("token refreshed: user=%s, session=%s", username, sessionID)
+	c.JSON(http.StatusOK, gin.H{
+		"username":      username,
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int64(utils.AccessTokenTTL.Seconds()),
+	})
+}
+
+func Logout(c *gin.Context) {
+	username := middleware.TokenOwner(c)
+	if err := redis.DeleteToken(c.GetString("token")); err != nil {
+		log.Log.Errorf("logout failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "logout failed"})
+		return
+	}
+	if _, err := redis.DeleteSession(username, c.GetString("session_id")); err != nil {
+		log.Log.Errorf("logout failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "logout failed"})
+		return
+	}
+	log.Log.Infof("logout success: %s", username)
+	c.JSON(http.StatusOK, gin.H{"message": "logout success"})
+}
+
+func LogoutAll(c *gin.Context) {
+	username := middleware.TokenOwner(c)
+	count, err := redis.DeleteAllSessions(username)
+	if err != nil {
+		log.Log.Errorf("logout all failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "logout failed"})
+		return
+	}
+	log.Log.Infof("logout all sessions success: %s, count=%d", username, count)
+	c.JSON(http.StatusOK, gin.H{"message": "logout success", "revoked": count})
+}
+
+// admin only
+func ListUserSessions(c *gin.Context) {
+	username := c.Param("username")
+	sessions, err := redis.ListSessions(username)
+	if err != nil {
+		log.Log.Errorf("list sessions failed: user=%s, err=%v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	log.Log.Infof("admin %s listed sessions of %s: %d", c.GetString("username"), username, len(sessions))
+	c.JSON(http.StatusOK, gin.H{"username": username, "sessions": sessions})
+}
+
+// admin only
+func RevokeUserSession(c *gin.Context) {
+	username := c.Param("username")
+	sessionID := c.Param("sessionId")
+	found, err := redis.DeleteSession(username, sessionID)
+	if err != nil {
+		log.Log.Errorf("revoke session failed: user=%s, err=%v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not exist"})
+		return
+	}
+	log.Log.Infof("admin %s revoked session %s of %s", c.GetString("username"), sessionID, username)
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// admin only
+func RevokeAllUserSessions(c *gin.Context) {
+	username := c.Param("username")
+	count, err := redis.DeleteAllSessions(username)
+	if err != nil {
+		log.Log.Errorf("revoke all sessions failed: user=%s, err=%v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "revoke failed"})
+		return
+	}
+	log.Log.Infof("admin %s revoked all sessions of %s: %d", c.GetString("username"), username, count)
+	c.JSON(http.StatusOK, gin.H{"message": "sessions revoked", "revoked": count})
+}
+
+// admin only
+func ListImpersonationAudit(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	entries, err := redis.ListImpersonationAudit(limit)
+	if err != nil {
+		log.Log.Errorf("list impersonation audit failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
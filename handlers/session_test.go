@@ -0,0 +1,33 @@
+package handlers_test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	api := newTestAPI(t)
+	_, refresh := api.login("alice")
+
+	out := api.expect(http.StatusOK, "POST", "/api/token/refresh", "", map[string]string{"refresh_token": refresh})
+	newAccess, newRefresh := out["token"].(string), out["refresh_token"].(string)
+	api.expect(http.StatusOK, "GET", "/api/chatrooms", newAccess, nil)
+
+	// presenting the old refresh token again revokes the whole session
+	api.expect(http.StatusUnauthorized, "POST", "/api/token/refresh", "", map[string]string{"refresh_token": refresh})
+	api.expect(http.StatusUnauthorized, "GET", "/api/chatrooms", newAccess, nil)
+	api.expect(http.StatusUnauthorized, "POST", "/api/token/refresh", "", map[string]string{"refresh_token": newRefresh})
+}
+
+func TestLogout(t *testing.T) {
+	api := newTestAPI(t)
+	first, _ := api.login("alice")
+	out := api.expect(http.StatusOK, "POST", "/api/login", "", map[string]string{"username": "alice", "password": "secret-alice"})
+	second := out["token"].(string)
+
+	api.expect(http.StatusOK, "POST", "/api/logout", first, nil)
+	api.expect(http.StatusUnauthorized, "GET", "/api/chatrooms", first, nil)
+	api.expect(http.StatusOK, "GET", "/api/chatrooms", second, nil)
+	api.expect(http.StatusOK, "POST", "/api/logout/all", second, nil)
+	api.expect(http.StatusUnauthorized, "GET", "/api/chatrooms", second, nil)
+}
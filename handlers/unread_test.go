@@ -0,0 +1,53 @@
+package handlers_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// unreadOf returns the unread count of roomID in the room list of username.
+func (a *testAPI) unreadOf(token, username, roomID string) float64 {
+	a.t.Helper()
+	out := a.expect(http.StatusOK, "GET", "/api/chatrooms/user/"+username, token, nil)
+	rooms, _ := out["rooms"].([]any)
+	for _, r := range rooms {
+		if room := r.(map[string]any); room["id"] == roomID {
+			return room["unread_count"].(float64)
+		}
+	}
+	a.t.Fatalf("room %s not in the list of %s: %v", roomID, username, out)
+	return 0
+}
+
+func TestUnreadCounts(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	room := api.createRoom(alice, "general", false)
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, map[string]any{"chatroom_id": room})
+	for _, text := range []string{"one", "two", "three"} {
+		api.post(alice, room, text)
+	}
+
+	if n := api.unreadOf(bob, "bob", room); n != 3 {
+		t.Fatalf("bob unread = %v, want 3", n)
+	}
+	if n := api.unreadOf(alice, "alice", room); n != 0 {
+		t.Fatalf("own messages counted: alice unread = %v", n)
+	}
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/read", bob, nil)
+	if n := api.unreadOf(bob, "bob", room); n != 0 {
+		t.Fatalf("bob unread after reading = %v, want 0", n)
+	}
+
+	// past the limit the count is a lower bound
+	for i := 0; i <= 100; i++ {
+		api.post(alice, room, fmt.Sprint(i))
+	}
+	out := api.expect(http.StatusOK, "GET", "/api/chatrooms/user/bob", bob, nil)
+	entry := out["rooms"].([]any)[0].(map[string]any)
+	if entry["unread_count"] != float64(100) || entry["unread_more"] != true {
+		t.Fatalf("unread = %v (more %v), want 100+", entry["unread_count"], entry["unread_more"])
+	}
+}
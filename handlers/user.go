@@ -1,20 +1,16 @@
 package handlers
 
 import (
-	//"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"chatroom-api/dynamodb"
 	log "chatroom-api/logger"
+	"chatroom-api/models"
 	"chatroom-api/redis"
+	"chatroom-api/store"
 	"chatroom-api/utils"
-	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
-	"strings"
-	"time"
 )
 
-var ctx = context.Background()
-
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -29,16 +25,22 @@ func Register(c *gin.Context) {
 	}
 	log.Log.Infof("User registration request: %s", req.Username)
 
-	user := dynamodb.User{
+	hash, err := utils.HashPassword(req.Password)
+	if err != nil {
+		log.Log.Errorf("hash password failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "sign up failed"})
+		return
+	}
+	user := models.User{
 		Username: req.Username,
-		Password: req.Password,
+		Password: hash,
 	}
 
-	err := dynamodb.CreateUser(user)
+	err = store.Users.CreateUser(user)
 	if err != nil {
 		log.Log.Warnf("user create failed: %v", err)
 
-		if strings.Contains(err.Error(), "ConditionalCheckFailed") {
+		if errors.Is(err, store.ErrUserExists) {
 			log.Log.Infof("Username already exists: %s", req.Username)
 			c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
 		} else {
@@ -56,26 +58,37 @@ func HealthCheck(c *gin.Context) {
 
 func Login(c *gin.Context) {
 	log.Log.Info("Login Hit!")
-	var req dynamodb.User
+	var req models.User
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "wrong request format"})
 		return
 	}
 
 	// get user
-	user, err := dynamodb.GetUserByUsername(req.Username)
+	user, err := store.Users.GetUserByUsername(req.Username)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "username not exist"})
 		return
 	}
 
 	// password
-	if user.Password != req.Password {
+	if !utils.CheckPassword(user.Password, req.Password) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong password"})
 		return
 	}
 
-	token, err := utils.GenerateToken(req.Username)
+	// migrate plaintext passwords stored before hashing was introduced
+	if !utils.IsPasswordHashed(user.Password) {
+		if hash, err := utils.HashPassword(req.Password); err != nil {
+			log.Log.Errorf("hash password failed: %v", err)
+		} else if err := store.Users.UpdateUserPassword(user.Username, hash); err != nil {
+			log.Log.Errorf("re-hash password failed: username=%s, err=%v", user.Username, err)
+		} else {
+			log.Log.Infof("plaintext password migrated to hash: %s", user.Username)
+		}
+	}
+
+	token, refreshToken, err := issueTokens(req.Username, redis.NewSessionID(), false)
 	if err != nil {
 		log.Log.Errorf("Token generated failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generated failed"})
@@ -83,12 +96,12 @@ func Login(c *gin.Context) {
 	}
 	log.Log.Infof("login success: %s，Token generated", req.Username)
 
-	redis.Rdb.Set(ctx, "token:"+token, req.Username, 24*time.Hour)
-
 	c.JSON(http.StatusOK, gin.H{
-		"message":  "login success",
-		"username": req.Username,
-		"token":    token,
+		"message":       "login success",
+		"username":      req.Username,
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_in":    int64(utils.AccessTokenTTL.Seconds()),
 	})
 
 }
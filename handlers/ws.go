@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"chatroom-api/authz"
+	log "chatroom-api/logger"
+	"chatroom-api/redis"
+	"chatroom-api/store"
+	"chatroom-api/ws"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"strings"
+)
+
+// Frame sent by clients over the WebSocket.
+type WSInbound struct {
+	Type          string   `json:"type"` // "message", "heartbeat" or "typing"
+	Text          string   `json:"text"`
+	ParentID      string   `json:"parent_id,omitempty"`      // reply in a thread
+	AttachmentIDs []string `json:"attachment_ids,omitempty"` // uploads of UploadAttachment
+	Status        string   `json:"status,omitempty"`         // heartbeat: online or away, default unchanged
+	Typing        *bool    `json:"typing,omitempty"`         // typing: false when the user stopped, default true
+}
+
+// ServeWS: /ws/:roomId, room access is checked by middleware.RoomAccess.
+// Anyone who can read the room receives its events, only members can post.
+func ServeWS(c *gin.Context) {
+	roomID := c.Param("roomId")
+	username := c.GetString("username")
+	log.Log.Infof("WebSocket connect request: user=%s, room=%s", username, roomID)
+
+	if err := ws.DefaultHub.Serve(c.Writer, c.Request, roomID, username, wsHandlers); err != nil {
+		log.Log.Warnf("WebSocket upgrade failed: %v", err)
+	}
+}
+
+func handleWSMessage(client *ws.Client, data []byte) {
+	var in WSInbound
+	if err := json.Unmarshal(data, &in); err != nil {
+		client.SendError("invalid frame")
+		return
+	}
+	switch in.Type {
+	case "message", "":
+		if !canPostWS(client) {
+			client.SendError("not a member of this chatroom")
+			return
+		}
+		text := strings.TrimSpace(in.Text)
+		if text == "" && len(in.AttachmentIDs) == 0 {
+			client.SendError("empty message")
+			return
+		}
+		_, err := sendMessage(client.RoomID, client.Username, text, in.ParentID, in.AttachmentIDs)
+		if errors.Is(err, store.ErrMessageNotFound) {
+			client.SendError("parent message not exist")
+			return
+		}
+		if errors.Is(err, errAttachmentInvalid) || errors.Is(err, errTooManyAttachments) {
+			client.SendError(err.Error())
+			return
+		}
+		if err != nil {
+			log.Log.Errorf("save message failed: %v", err)
+			client.SendError("send failed")
+		}
+	case "heartbeat":
+		status := client.Status()
+		if in.Status != "" {
+			if !redis.ValidStatus(in.Status) {
+				client.SendError("status must be online or away")
+				return
+			}
+			status = in.Status
+		}
+		setPresence(client, status)
+	case "typing":
+		sendTyping(client, in.Typing == nil || *in.Typing)
+	default:
+		client.SendError("unknown frame type")
+	}
+}
+
+// canPostWS checks the membership again, it may have changed since the connection was opened.
+func canPostWS(client *ws.Client) bool {
+	chatroom, err := store.ChatroomWith(client.RoomID, client.Username)
+	return err == nil && authz.Can(client.Username, chatroom, authz.PostMessage)
+}
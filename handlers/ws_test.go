@@ -0,0 +1,100 @@
+package handlers_test
+
+import (
+	"chatroom-api/ws"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dial opens the room's WebSocket, passing the token the way browsers do.
+func (a *testAPI) dial(roomID, token string) *websocket.Conn {
+	a.t.Helper()
+	url := "ws" + strings.TrimPrefix(a.srv.URL, "http") + "/ws/" + roomID
+	dialer := websocket.Dialer{Subprotocols: []string{ws.TokenProtocol, token}}
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		a.t.Fatalf("dial %s: %v (%v)", roomID, err, resp)
+	}
+	if conn.Subprotocol() != ws.TokenProtocol {
+		a.t.Fatalf("subprotocol = %q, want %q", conn.Subprotocol(), ws.TokenProtocol)
+	}
+	a.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nextEvent reads frames until one of type typ arrives.
+func nextEvent(t *testing.T, conn *websocket.Conn, typ string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_ = conn.SetReadDeadline(deadline)
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q event: %v", typ, err)
+		}
+		var ev map[string]any
+		if err := json.Unmarshal(data, &ev); err != nil {
+			t.Fatalf("invalid frame %s: %v", data, err)
+		}
+		if ev["type"] == typ {
+			return ev
+		}
+	}
+}
+
+func TestWebSocketMessaging(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	room := api.createRoom(alice, "general", false)
+
+	conn := api.dial(room, alice)
+	if err := conn.WriteJSON(map[string]string{"type": "message", "text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	ev := nextEvent(t, conn, "message")
+	if data := ev["data"].(map[string]any); data["text"] != "hello" || data["sender"] != "alice" {
+		t.Fatalf("message event = %v", ev)
+	}
+
+	// the token is required, on either path
+	url := "ws" + strings.TrimPrefix(api.srv.URL, "http") + "/ws/" + room
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial without token: %v, %v", err, resp)
+	}
+	legacy, _, err := websocket.DefaultDialer.Dial(url+"?token="+alice, nil)
+	if err != nil {
+		t.Fatalf("dial with ?token=: %v", err)
+	}
+	legacy.Close()
+}
+
+func TestLeavingClosesSockets(t *testing.T) {
+	api := newTestAPI(t)
+	alice, _ := api.login("alice")
+	bob, _ := api.login("bob")
+	room := api.createRoom(alice, "team", true)
+	code := api.expect(http.StatusOK, "POST", "/api/chatrooms/"+room+"/invites", alice, map[string]any{"username": "bob"})["code"]
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/join", bob, map[string]any{"chatroom_id": room, "invite_code": code})
+	watcher := api.dial(room, alice)
+	leaver := api.dial(room, bob)
+
+	api.expect(http.StatusNotFound, "POST", "/api/chatrooms/exit", bob, map[string]any{"chatroom_id": "nope"})
+	api.expect(http.StatusOK, "POST", "/api/chatrooms/exit", bob, map[string]any{"chatroom_id": room})
+	if data := nextEvent(t, watcher, "member_removed")["data"].(map[string]any); data["username"] != "bob" {
+		t.Fatalf("member_removed = %v, want bob", data)
+	}
+	nextEvent(t, leaver, "member_removed")
+	api.post(alice, room, "secret")
+	_ = leaver.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := leaver.ReadMessage()
+		if err != nil {
+			break
+		}
+		t.Fatalf("the socket of a user who left received %s", data)
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"chatroom-api/blob"
 	"chatroom-api/dynamodb"
+	"chatroom-api/handlers"
 	"chatroom-api/logger"
 	"chatroom-api/redis"
 	"chatroom-api/router"
+	"chatroom-api/store"
+	"chatroom-api/utils"
+	"chatroom-api/ws"
 	"github.com/joho/godotenv"
+	"os"
 )
 
 func main() {
@@ -21,16 +27,86 @@ func main() {
 		log.Info(".env loaded successfully")
 	}
 
-	log.Info("Starting database initialization.")
-	dynamodb.InitDB()
-	log.Info("Database initialization completed.")
+	// STORE_BACKEND=memory runs the whole API without DynamoDB (data is lost on restart)
+	backend := os.Getenv("STORE_BACKEND")
+	switch backend {
+	case "memory":
+		log.Warn("Using in-memory storage backend.")
+		store.Init(store.NewMemoryStore())
+	default:
+		log.Info("Starting database initialization.")
+		dynamodb.InitDB()
+		log.Info("Database initialization completed.")
+
+		if err := dynamodb.CreateAllTables(); err != nil {
+			log.Warnf("Failed to create DynamoDB tables: %v (ignored)", err)
+		}
+		// the legacy timestamp-keyed messages table is copied before serving, once;
+		// MIGRATE_MESSAGES=true copies it again (e.g. after old replicas kept writing to it)
+		force := os.Getenv("MIGRATE_MESSAGES") == "true"
+		if err := dynamodb.RunMigration(dynamodb.MigrationLegacyMessages, force, dynamodb.MigrateLegacyMessages); err != nil {
+			log.Errorf("Messages migration failed: %v", err)
+		}
+		// the users lists of room items are moved into room_members before serving, once;
+		// MIGRATE_MEMBERS=true runs it again (rooms it missed are picked up, the rest skipped)
+		force = os.Getenv("MIGRATE_MEMBERS") == "true"
+		if err := dynamodb.RunMigration(dynamodb.MigrationRoomMembers, force, dynamodb.MigrateRoomMembers); err != nil {
+			log.Errorf("Room members migration failed: %v", err)
+		}
+		store.Init(dynamodb.Store{})
+	}
+
+	if err := utils.CheckFileURLSecret(); err != nil {
+		log.Fatalf("Attachment downloads cannot be signed: %v", err)
+	}
+	// BLOB_BACKEND=s3 keeps attachments in S3_BUCKET, the local BLOB_DIR otherwise
+	if os.Getenv("BLOB_BACKEND") == "s3" {
+		s3Store, err := blob.NewS3Store()
+		if err != nil {
+			log.Fatalf("S3 blob store initialization failed: %v", err)
+		}
+		if err := s3Store.EnsureBucket(); err != nil {
+			log.Warnf("Failed to create S3 bucket: %v (ignored)", err)
+		}
+		blob.Default = s3Store
+	} else {
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "uploads"
+		}
+		log.Infof("Storing attachments under %s", dir)
+		blob.Default = blob.NewFileStore(dir)
+	}
 
 	log.Info("Initializing Redis connection")
 	redis.InitRedis()
 	log.Info("Redis connection initialized")
+	handlers.StartPresenceSweeper()
+	handlers.StartUploadSweeper()
+
+	// messages sent before search existed are indexed in the background, once;
+	// SEARCH_BACKFILL=true indexes everything again (e.g. after Redis lost its data)
+	if backend != "memory" {
+		force := os.Getenv("SEARCH_BACKFILL") == "true"
+		go func() {
+			err := dynamodb.RunMigration(dynamodb.MigrationSearchIndex, force, func() error {
+				return dynamodb.ScanChatroomIDs(func(roomID string) error {
+					_, err := handlers.BackfillSearchIndex(roomID)
+					return err
+				})
+			})
+			if err != nil {
+				log.Errorf("Search index backfill failed: %v", err)
+			}
+		}()
+	}
 
-	if err := dynamodb.CreateAllTables(); err != nil {
-		log.Warn("Failed to create DynamoDB tables: %v (ignored)", err)
+	// MESSAGE_BUS=local keeps WebSocket fan-out in process (single replica only)
+	if os.Getenv("MESSAGE_BUS") == "local" {
+		log.Warn("Using in-process message bus, messages are not shared between replicas.")
+	} else {
+		log.Info("Using Redis Pub/Sub message bus")
+		ws.DefaultHub = ws.NewHub(redis.NewRoomBus())
 	}
 
 	r := router.SetupRouter()
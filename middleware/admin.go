@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"chatroom-api/authz"
+	log "chatroom-api/logger"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func IsAdmin(username string) bool {
+	return authz.IsAdmin(username)
+}
+
+// Admin middleware: must run after AuthMiddleware
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetString("username")
+		if !IsAdmin(username) {
+			log.Log.Warnf("Admin access denied: %s", username)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin privileges required."})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -2,8 +2,11 @@ package middleware
 
 import (
 	log "chatroom-api/logger"
+	"chatroom-api/redis"
 	"chatroom-api/utils"
+	"chatroom-api/ws"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"net/http"
 	"strings"
 )
@@ -21,19 +24,72 @@ func AuthMiddleware() gin.HandlerFunc {
 
 		// token
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		authenticate(c, tokenString)
+	}
+}
 
-		// get username
-		username, err := utils.ParseToken(tokenString)
-		if err != nil {
-			log.Log.Warnf("Authentication failed: Token is invalid or expired.err=%v", err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token is invalid or expired."})
+// WebSocket authentication: browsers can not set headers on the upgrade request, so the
+// token is passed as a subprotocol ("access_token, <jwt>", see ws.TokenProtocol).
+// ?token= is still accepted from older clients, the access log redacts it.
+func WSAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := protocolToken(c.Request)
+		if tokenString == "" {
+			tokenString = c.Query("token")
+		}
+		if tokenString == "" {
+			tokenString = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if tokenString == "" {
+			log.Log.Warn("WebSocket authentication failed: missing token.")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token."})
 			c.Abort()
 			return
 		}
-		log.Log.Infof("Authentication successful:%s", username)
-		// Set the username in the context for use by handlers.
-		c.Set("username", username)
+		authenticate(c, tokenString)
+	}
+}
 
-		c.Next()
+// protocolToken returns the subprotocol offered after ws.TokenProtocol, if any.
+func protocolToken(r *http.Request) string {
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == ws.TokenProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
 	}
+	return ""
+}
+
+func authenticate(c *gin.Context, tokenString string) {
+	// get username
+	username, sessionID, err := utils.ParseToken(tokenString)
+	if err != nil {
+		log.Log.Warnf("Authentication failed: Token is invalid or expired.err=%v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token is invalid or expired."})
+		c.Abort()
+		return
+	}
+
+	// the token must still have a live session in Redis (not logged out / revoked)
+	active, err := redis.SessionExists(tokenString)
+	if err != nil {
+		log.Log.Errorf("Authentication failed: session lookup error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Session check failed."})
+		c.Abort()
+		return
+	}
+	if !active {
+		log.Log.Warnf("Authentication failed: token has been revoked: %s", username)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked."})
+		c.Abort()
+		return
+	}
+	log.Log.Infof("Authentication successful:%s", username)
+	// Set the username in the context for use by handlers.
+	c.Set("username", username)
+	c.Set("token", tokenString)
+	c.Set("session_id", sessionID)
+
+	c.Next()
 }
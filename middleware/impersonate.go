@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/redis"
+	"chatroom-api/store"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// ImpersonateHeader lets an admin act as another user (support staff). Every request
+// made this way is written to the impersonation audit log.
+const ImpersonateHeader = "X-Act-As"
+
+// Impersonation must run after AuthMiddleware. When the header is set by an admin,
+// "username" becomes the target user and "impersonator" holds the admin.
+func Impersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		target := c.GetHeader(ImpersonateHeader)
+		if target == "" {
+			c.Next()
+			return
+		}
+		admin := c.GetString("username")
+		if !IsAdmin(admin) {
+			log.Log.Warnf("Impersonation denied: %s -> %s", admin, target)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin privileges required to impersonate."})
+			c.Abort()
+			return
+		}
+		if _, err := store.Users.GetUserByUsername(target); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not exist"})
+			c.Abort()
+			return
+		}
+
+		// no audit record, no impersonation
+		err := redis.AuditImpersonation(redis.ImpersonationAudit{
+			Time:   time.Now().Format(time.RFC3339),
+			Admin:  admin,
+			Target: target,
+			Method: c.Request.Method,
+			Path:   c.Request.URL.Path,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Impersonation audit failed."})
+			c.Abort()
+			return
+		}
+		log.Log.Warnf("Impersonation: admin=%s acting as %s: %s %s", admin, target, c.Request.Method, c.Request.URL.Path)
+		c.Set("impersonator", admin)
+		c.Set("username", target)
+		c.Next()
+	}
+}
+
+// TokenOwner returns the user the token was issued to, even while impersonating.
+func TokenOwner(c *gin.Context) string {
+	if admin := c.GetString("impersonator"); admin != "" {
+		return admin
+	}
+	return c.GetString("username")
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"chatroom-api/authz"
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/store"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// RoomAccess loads the :roomId room and checks that the authenticated user may perform
+// the action on it. The room is stored in the context as "chatroom", with only the caller's
+// membership loaded (store.ChatroomWith). Must run after auth.
+func RoomAccess(action authz.Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Param("roomId")
+		username := c.GetString("username")
+
+		chatroom, err := store.ChatroomWith(roomID, username)
+		if errors.Is(err, store.ErrChatroomNotFound) {
+			log.Log.Warnf("query chatroom failed: %v", err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "chatroom not exist"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			log.Log.Errorf("query chatroom failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "query failed"})
+			c.Abort()
+			return
+		}
+		if !authz.Can(username, chatroom, action) {
+			log.Log.Warnf("Room access denied: user=%s, room=%s, action=%s", username, roomID, action)
+			msg := "not a member of this chatroom"
+			if action != authz.ReadRoom && action != authz.PostMessage {
+				msg = "permission denied: " + action.String()
+			}
+			c.JSON(http.StatusForbidden, gin.H{"error": msg})
+			c.Abort()
+			return
+		}
+		c.Set("chatroom", chatroom)
+		c.Next()
+	}
+}
+
+// Chatroom returns the room loaded by RoomAccess.
+func Chatroom(c *gin.Context) models.Chatroom {
+	return c.MustGet("chatroom").(models.Chatroom)
+}
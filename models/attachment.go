@@ -0,0 +1,19 @@
+package models
+
+// Attachment is a file uploaded to a room, stored in the blob store under BlobKey.
+// Its metadata is kept on the message that carries it.
+type Attachment struct {
+	AttachmentID string `json:"attachment_id" dynamodbav:"attachment_id"`
+	RoomID       string `json:"room_id" dynamodbav:"room_id"`
+	FileName     string `json:"file_name" dynamodbav:"file_name"`
+	ContentType  string `json:"content_type" dynamodbav:"content_type"`
+	Size         int64  `json:"size" dynamodbav:"size"`
+	UploadedBy   string `json:"uploaded_by" dynamodbav:"uploaded_by"`
+	UploadedAt   string `json:"uploaded_at" dynamodbav:"uploaded_at"`
+	// signed download link for the requesting user, never stored
+	URL string `json:"url,omitempty" dynamodbav:"-"`
+}
+
+func (a Attachment) BlobKey() string {
+	return a.RoomID + "/" + a.AttachmentID
+}
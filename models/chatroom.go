@@ -1,8 +1,100 @@
 package models
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// DirectoryPublic is the partition of the room directory indexes, private rooms leave it empty.
+const DirectoryPublic = "public"
+
 type Chatroom struct {
-	RoomID    string `json:"room_id"`
-	Name      string `json:"name"`
-	IsPrivate bool   `json:"is_private"`
-	CreatedBy string `json:"created_by"`
+	RoomID    string `json:"room_id" dynamodbav:"room_id"`
+	Name      string `json:"name" dynamodbav:"name"`
+	IsPrivate bool   `json:"is_private" dynamodbav:"is_private"`
+	CreatedBy string `json:"created_by" dynamodbav:"created_by"`
+	CreatedAt string `json:"created_at" dynamodbav:"created_at"`
+	// Version is incremented on every write of the room item (optimistic locking), 0 for old items
+	Version int64 `json:"version" dynamodbav:"version"`
+	// MemberCount is maintained together with the room_members items
+	MemberCount int `json:"member_count" dynamodbav:"member_count"`
+	// directory index keys, see SetDirectoryKeys
+	Directory string `json:"-" dynamodbav:"directory,omitempty"`
+	NameLower string `json:"-" dynamodbav:"name_lower,omitempty"`
+	// DMUsers is the sorted pair of a direct message room, empty for normal rooms.
+	// Unlike Users it stays on the room item, so room lists can show the other participant.
+	DMUsers []string `json:"dm_users,omitempty" dynamodbav:"dm_users,omitempty"`
+	// Users, Roles, LastRead and JoinedAt hold the room_members items the caller loaded (see AddMember),
+	// they are not stored on the room item
+	Users []string `json:"users" dynamodbav:"-"`
+	// username -> owner/admin/moderator, members without an entry are plain members
+	Roles map[string]string `json:"roles,omitempty" dynamodbav:"-"`
+	// username -> last read message_id
+	LastRead map[string]string `json:"-" dynamodbav:"-"`
+	// username -> joined_at
+	JoinedAt map[string]string `json:"-" dynamodbav:"-"`
+}
+
+// AddMember fills Users, Roles, LastRead and JoinedAt with a loaded membership.
+func (c *Chatroom) AddMember(m Member) {
+	c.Users = append(c.Users, m.Username)
+	if m.JoinedAt != "" {
+		if c.JoinedAt == nil {
+			c.JoinedAt = map[string]string{}
+		}
+		c.JoinedAt[m.Username] = m.JoinedAt
+	}
+	if m.Role != "" {
+		if c.Roles == nil {
+			c.Roles = map[string]string{}
+		}
+		c.Roles[m.Username] = m.Role
+	}
+	if m.LastReadID != "" {
+		if c.LastRead == nil {
+			c.LastRead = map[string]string{}
+		}
+		c.LastRead[m.Username] = m.LastReadID
+	}
+}
+
+func (c Chatroom) IsDM() bool {
+	return len(c.DMUsers) > 0
+}
+
+// DMPeer returns the other participant of a direct message room.
+func (c Chatroom) DMPeer(username string) string {
+	for _, u := range c.DMUsers {
+		if u != username {
+			return u
+		}
+	}
+	return username
+}
+
+// DMUsersOf returns the pair in canonical order.
+func DMUsersOf(a, b string) []string {
+	users := []string{a, b}
+	sort.Strings(users)
+	return users
+}
+
+// DMRoomID is the deterministic room id of the direct messages between a and b,
+// the same for both orders, so the room can only be created once.
+func DMRoomID(a, b string) string {
+	users := DMUsersOf(a, b)
+	sum := sha256.Sum256([]byte(users[0] + "\x00" + users[1]))
+	return "dm-" + hex.EncodeToString(sum[:12])
+}
+
+// SetDirectoryKeys fills the directory index attributes from Name and IsPrivate.
+// Private rooms and direct messages get none, so they never appear in the directory indexes.
+func (c *Chatroom) SetDirectoryKeys() {
+	c.Directory, c.NameLower = "", ""
+	if !c.IsPrivate && !c.IsDM() {
+		c.Directory = DirectoryPublic
+		c.NameLower = strings.ToLower(c.Name)
+	}
 }
@@ -0,0 +1,14 @@
+package models
+
+// Invite lets a user join a private room.
+type Invite struct {
+	Code       string `json:"code" dynamodbav:"code"` //primary key
+	RoomID     string `json:"room_id" dynamodbav:"room_id"`
+	CreatedBy  string `json:"created_by" dynamodbav:"created_by"`
+	CreatedAt  string `json:"created_at" dynamodbav:"created_at"`
+	ExpiresAt  int64  `json:"expires_at" dynamodbav:"expires_at"` // unix seconds, 0 = never
+	MaxUses    int    `json:"max_uses" dynamodbav:"max_uses"`     // 0 = unlimited, 1 = single-use
+	Uses       int    `json:"uses" dynamodbav:"uses"`
+	TargetUser string `json:"target_user,omitempty" dynamodbav:"target_user"` // only this user may use it
+	Revoked    bool   `json:"revoked" dynamodbav:"revoked"`
+}
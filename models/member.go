@@ -0,0 +1,12 @@
+package models
+
+// Member is one user's membership of a room (room_members table).
+type Member struct {
+	RoomID   string `json:"room_id" dynamodbav:"room_id"`
+	Username string `json:"username" dynamodbav:"username"`
+	Role     string `json:"role,omitempty" dynamodbav:"role,omitempty"` // empty for plain members
+	JoinedAt string `json:"joined_at" dynamodbav:"joined_at"`
+	// read receipt: the newest message the member has read, only moves forward
+	LastReadID string `json:"last_read_id,omitempty" dynamodbav:"last_read_id,omitempty"`
+	LastReadAt string `json:"last_read_at,omitempty" dynamodbav:"last_read_at,omitempty"`
+}
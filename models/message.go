@@ -0,0 +1,73 @@
+package models
+
+import (
+	"chatroom-api/utils"
+	"time"
+)
+
+type Message struct {
+	RoomID    string `json:"room_id" dynamodbav:"room_id"`
+	MessageID string `json:"message_id" dynamodbav:"message_id"` // ULID, sort key
+	Timestamp string `json:"timestamp" dynamodbav:"timestamp"`
+	Sender    string `json:"sender" dynamodbav:"sender"`
+	Text      string `json:"text" dynamodbav:"text"`
+	// files uploaded before the message was sent, removed with the message
+	Attachments []Attachment `json:"attachments,omitempty" dynamodbav:"attachments,omitempty"`
+	EditedAt    string       `json:"edited_at,omitempty" dynamodbav:"edited_at,omitempty"`
+	// tombstone: the text is removed, the previous version is kept in the revisions
+	Deleted   bool   `json:"deleted,omitempty" dynamodbav:"deleted,omitempty"`
+	DeletedAt string `json:"deleted_at,omitempty" dynamodbav:"deleted_at,omitempty"`
+	DeletedBy string `json:"deleted_by,omitempty" dynamodbav:"deleted_by,omitempty"`
+	// replies: ParentID is the message answered, ThreadRootID the top-level message of the thread
+	ParentID     string `json:"parent_id,omitempty" dynamodbav:"parent_id,omitempty"`
+	ThreadRootID string `json:"thread_root_id,omitempty" dynamodbav:"thread_root_id,omitempty"`
+	// set on thread roots when a reply is saved
+	ReplyCount  int    `json:"reply_count,omitempty" dynamodbav:"reply_count,omitempty"`
+	LastReplyAt string `json:"last_reply_at,omitempty" dynamodbav:"last_reply_at,omitempty"`
+	// filled from the reactions table when messages are returned to a user
+	Reactions []ReactionSummary `json:"reactions,omitempty" dynamodbav:"-"`
+}
+
+// MessageRevision is a previous version of an edited or deleted message.
+type MessageRevision struct {
+	RoomID      string `json:"room_id" dynamodbav:"room_id"`
+	RevisionKey string `json:"-" dynamodbav:"revision_key"` // <message_id>#<revision ULID>, sort key
+	MessageID   string `json:"message_id" dynamodbav:"message_id"`
+	Text        string `json:"text" dynamodbav:"text"`     // the text before the change
+	Action      string `json:"action" dynamodbav:"action"` // "edit" or "delete"
+	ChangedBy   string `json:"changed_by" dynamodbav:"changed_by"`
+	ChangedAt   string `json:"changed_at" dynamodbav:"changed_at"`
+}
+
+func NewMessageRevision(msg Message, action, by string, at time.Time) MessageRevision {
+	return MessageRevision{
+		RoomID:      msg.RoomID,
+		RevisionKey: msg.MessageID + "#" + utils.NewULID(),
+		MessageID:   msg.MessageID,
+		Text:        msg.Text,
+		Action:      action,
+		ChangedBy:   by,
+		ChangedAt:   at.Format(time.RFC3339),
+	}
+}
+
+// NewReply creates a reply to parent, in the thread of parent's root.
+func NewReply(parent Message, sender, text string) Message {
+	msg := NewMessage(parent.RoomID, sender, text)
+	msg.ParentID = parent.MessageID
+	msg.ThreadRootID = parent.ThreadRootID
+	if msg.ThreadRootID == "" {
+		msg.ThreadRootID = parent.MessageID
+	}
+	return msg
+}
+
+func NewMessage(roomID, sender, text string) Message {
+	return Message{
+		RoomID:    roomID,
+		MessageID: utils.NewULID(),
+		Sender:    sender,
+		Text:      text,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+}
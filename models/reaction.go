@@ -0,0 +1,53 @@
+package models
+
+// Reaction is one user's emoji on a message, keyed by room_id + <message_id>#<emoji>#<username>
+// so the reactions of a page of messages are one range of the room partition.
+type Reaction struct {
+	RoomID      string `json:"room_id" dynamodbav:"room_id"`
+	ReactionKey string `json:"-" dynamodbav:"reaction_key"`
+	MessageID   string `json:"message_id" dynamodbav:"message_id"`
+	Emoji       string `json:"emoji" dynamodbav:"emoji"`
+	Username    string `json:"username" dynamodbav:"username"`
+	CreatedAt   string `json:"created_at" dynamodbav:"created_at"`
+}
+
+// ReactionSummary aggregates the reactions of one emoji on a message.
+type ReactionSummary struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"` // the requesting user is one of them
+}
+
+func ReactionKey(messageID, emoji, username string) string {
+	return messageID + "#" + emoji + "#" + username
+}
+
+func NewReaction(roomID, messageID, emoji, username, createdAt string) Reaction {
+	return Reaction{
+		RoomID:      roomID,
+		ReactionKey: ReactionKey(messageID, emoji, username),
+		MessageID:   messageID,
+		Emoji:       emoji,
+		Username:    username,
+		CreatedAt:   createdAt,
+	}
+}
+
+// SummarizeReactions groups reactions by message and emoji, keeping the order they come in.
+func SummarizeReactions(reactions []Reaction, username string) map[string][]ReactionSummary {
+	out := map[string][]ReactionSummary{}
+	for _, r := range reactions {
+		summaries := out[r.MessageID]
+		i := 0
+		for i < len(summaries) && summaries[i].Emoji != r.Emoji {
+			i++
+		}
+		if i == len(summaries) {
+			summaries = append(summaries, ReactionSummary{Emoji: r.Emoji})
+		}
+		summaries[i].Count++
+		summaries[i].Reacted = summaries[i].Reacted || r.Username == username
+		out[r.MessageID] = summaries
+	}
+	return out
+}
@@ -0,0 +1,52 @@
+package redis
+
+import (
+	log "chatroom-api/logger"
+	"encoding/json"
+)
+
+const (
+	impersonationAuditKey = "audit:impersonation"
+	auditMaxEntries       = 10000
+)
+
+type ImpersonationAudit struct {
+	Time   string `json:"time"`
+	Admin  string `json:"admin"`
+	Target string `json:"target"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// AuditImpersonation appends an entry to the capped impersonation audit log.
+func AuditImpersonation(entry ImpersonationAudit) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pipe := Rdb.TxPipeline()
+	pipe.LPush(ctx, impersonationAuditKey, data)
+	pipe.LTrim(ctx, impersonationAuditKey, 0, auditMaxEntries-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("write impersonation audit failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ListImpersonationAudit returns the newest entries first.
+func ListImpersonationAudit(limit int) ([]ImpersonationAudit, error) {
+	raw, err := Rdb.LRange(ctx, impersonationAuditKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := []ImpersonationAudit{}
+	for _, r := range raw {
+		var e ImpersonationAudit
+		if err := json.Unmarshal([]byte(r), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
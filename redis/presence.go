@@ -0,0 +1,176 @@
+package redis
+
+import (
+	log "chatroom-api/logger"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presence is tracked per WebSocket connection, so a user stays online while any of
+// their tabs or devices is connected:
+//
+//	presence:<username>          -> hash: connection id -> "<status>|<expires unix>"
+//	presence_expiry              -> sorted set: username by expiry of their latest heartbeat
+//	typing:<room_id>:<username>  -> set while a typing event is throttled
+//
+// Connections refresh their entry on every heartbeat. Entries of connections that died
+// without closing (crashed instance) stop counting once expired and are reported offline
+// by SweepPresence, the key itself expires 2*PresenceTTL after the last heartbeat of the user.
+const (
+	PresenceTTL       = 90 * time.Second
+	TypingThrottle    = 3 * time.Second
+	StatusOnline      = "online"
+	StatusAway        = "away"
+	StatusOffline     = "offline"
+	presenceKeyPrefix = "presence:"
+	presenceExpiryKey = "presence_expiry"
+)
+
+func presenceKey(username string) string {
+	return presenceKeyPrefix + username
+}
+
+func typingKey(roomID, username string) string {
+	return "typing:" + roomID + ":" + username
+}
+
+// ValidStatus reports whether a client may set status (offline is implied by disconnecting).
+func ValidStatus(status string) bool {
+	return status == StatusOnline || status == StatusAway
+}
+
+// aggregateStatus: online if any live connection is online, away if all live connections are away.
+func aggregateStatus(conns map[string]string, now int64) string {
+	status := StatusOffline
+	for _, v := range conns {
+		s, exp, ok := strings.Cut(v, "|")
+		expires, err := strconv.ParseInt(exp, 10, 64)
+		if !ok || err != nil || expires < now {
+			continue
+		}
+		if s == StatusOnline {
+			return StatusOnline
+		}
+		status = StatusAway
+	}
+	return status
+}
+
+// SetPresence records the status of one connection and refreshes its TTL.
+// It returns the user's status before and after, to detect changes.
+func SetPresence(username, connID, status string) (before, after string, err error) {
+	now := time.Now()
+	value := status + "|" + strconv.FormatInt(now.Add(PresenceTTL).Unix(), 10)
+	pipe := Rdb.TxPipeline()
+	prev := pipe.HGetAll(ctx, presenceKey(username))
+	pipe.HSet(ctx, presenceKey(username), connID, value)
+	// kept past the entry expiry, so SweepPresence still finds the stale entries
+	pipe.Expire(ctx, presenceKey(username), 2*PresenceTTL)
+	pipe.ZAdd(ctx, presenceExpiryKey, redis.Z{Score: float64(now.Add(PresenceTTL).Unix()), Member: username})
+	next := pipe.HGetAll(ctx, presenceKey(username))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("set presence failed: user=%s, err=%v", username, err)
+		return "", "", err
+	}
+	dropExpired(username, next.Val(), now.Unix())
+	return aggregateStatus(prev.Val(), now.Unix()), aggregateStatus(next.Val(), now.Unix()), nil
+}
+
+// RemovePresence forgets a closed connection, see SetPresence for the result.
+func RemovePresence(username, connID string) (before, after string, err error) {
+	now := time.Now().Unix()
+	pipe := Rdb.TxPipeline()
+	prev := pipe.HGetAll(ctx, presenceKey(username))
+	pipe.HDel(ctx, presenceKey(username), connID)
+	next := pipe.HGetAll(ctx, presenceKey(username))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("remove presence failed: user=%s, err=%v", username, err)
+		return "", "", err
+	}
+	return aggregateStatus(prev.Val(), now), aggregateStatus(next.Val(), now), nil
+}
+
+// dropExpired removes the entries of connections that stopped sending heartbeats.
+func dropExpired(username string, conns map[string]string, now int64) {
+	var stale []string
+	for id, v := range conns {
+		if aggregateStatus(map[string]string{id: v}, now) == StatusOffline {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		_ = Rdb.HDel(ctx, presenceKey(username), stale...).Err()
+	}
+}
+
+// claimExpiredScript pops the members of the sorted set KEYS[1] that expired before ARGV[1], at most
+// ARGV[2]. Popping in one step hands each member to a single instance; for presence a heartbeat
+// arriving afterwards adds the user back.
+var claimExpiredScript = redis.NewScript(`
+local users = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #users > 0 then
+	redis.call('ZREM', KEYS[1], unpack(users))
+end
+return users
+`)
+
+// SweepPresence returns the users who went offline because their connections stopped sending
+// heartbeats without closing, at most limit, and removes their stale entries. Users whose
+// connections all closed were already reported by RemovePresence and are skipped.
+func SweepPresence(limit int) ([]string, error) {
+	now := time.Now().Unix()
+	users, err := claimExpiredScript.Run(ctx, Rdb, []string{presenceExpiryKey}, now, limit).StringSlice()
+	if err != nil {
+		log.Log.Errorf("sweep presence failed: %v", err)
+		return nil, err
+	}
+	var offline []string
+	for _, u := range users {
+		conns, err := Rdb.HGetAll(ctx, presenceKey(u)).Result()
+		if err != nil {
+			log.Log.Errorf("sweep presence failed: user=%s, err=%v", u, err)
+			return offline, err
+		}
+		if len(conns) == 0 || aggregateStatus(conns, now) != StatusOffline {
+			continue
+		}
+		dropExpired(u, conns, now)
+		offline = append(offline, u)
+	}
+	return offline, nil
+}
+
+// GetPresence returns the status of each user, in one round trip.
+func GetPresence(usernames []string) (map[string]string, error) {
+	if len(usernames) == 0 {
+		return map[string]string{}, nil
+	}
+	pipe := Rdb.Pipeline()
+	cmds := make(map[string]*redis.MapStringStringCmd, len(usernames))
+	for _, u := range usernames {
+		cmds[u] = pipe.HGetAll(ctx, presenceKey(u))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("get presence failed: %v", err)
+		return nil, err
+	}
+	now := time.Now().Unix()
+	statuses := make(map[string]string, len(usernames))
+	for u, cmd := range cmds {
+		statuses[u] = aggregateStatus(cmd.Val(), now)
+	}
+	return statuses, nil
+}
+
+// StartTyping returns true if a typing event should be sent, at most once per TypingThrottle
+// for a user in a room across all instances.
+func StartTyping(roomID, username string) (bool, error) {
+	return Rdb.SetNX(ctx, typingKey(roomID, username), 1, TypingThrottle).Result()
+}
+
+// StopTyping lets the next StartTyping through immediately.
+func StopTyping(roomID, username string) error {
+	return Rdb.Del(ctx, typingKey(roomID, username)).Err()
+}
@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPresenceAggregate(t *testing.T) {
+	newTestRedis(t)
+	if _, after, _ := SetPresence("alice", "c1", StatusAway); after != StatusAway {
+		t.Fatalf("one away connection: status = %s, want away", after)
+	}
+	if before, after, _ := SetPresence("alice", "c2", StatusOnline); before != StatusAway || after != StatusOnline {
+		t.Fatalf("second connection online: %s -> %s, want away -> online", before, after)
+	}
+	if _, after, _ := RemovePresence("alice", "c2"); after != StatusAway {
+		t.Fatalf("after closing the online connection: status = %s, want away", after)
+	}
+	_, _, _ = RemovePresence("alice", "c1")
+	statuses, err := GetPresence([]string{"alice", "bob"})
+	if err != nil || statuses["alice"] != StatusOffline || statuses["bob"] != StatusOffline {
+		t.Fatalf("statuses = %v, %v, want both offline", statuses, err)
+	}
+}
+
+func TestSweepPresence(t *testing.T) {
+	mr := newTestRedis(t)
+	_, _, _ = SetPresence("alice", "c1", StatusOnline) // dies without closing
+	_, _, _ = SetPresence("bob", "c2", StatusOnline)   // closes
+	_, _, _ = RemovePresence("bob", "c2")
+	_, _, _ = SetPresence("carol", "c3", StatusOnline) // still alive
+
+	// alice's and bob's heartbeats expired
+	mr.HSet(presenceKey("alice"), "c1", StatusOnline+"|1")
+	for _, u := range []string{"alice", "bob"} {
+		if _, err := mr.ZAdd(presenceExpiryKey, 1, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offline, err := SweepPresence(100)
+	if err != nil || !reflect.DeepEqual(offline, []string{"alice"}) {
+		t.Fatalf("SweepPresence = %v, %v, want [alice]", offline, err)
+	}
+	if mr.Exists(presenceKey("alice")) {
+		t.Fatal("stale connection of alice was not removed")
+	}
+	if offline, _ := SweepPresence(100); len(offline) != 0 {
+		t.Fatalf("second sweep = %v, want nobody", offline)
+	}
+	if statuses, _ := GetPresence([]string{"carol"}); statuses["carol"] != StatusOnline {
+		t.Fatalf("carol = %s, want online", statuses["carol"])
+	}
+}
@@ -0,0 +1,105 @@
+package redis
+
+import (
+	log "chatroom-api/logger"
+	"context"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"sync"
+	"time"
+)
+
+const roomChannelPrefix = "room:"
+
+// RoomBus fans out room events between instances over Redis Pub/Sub.
+// A single PubSub connection is shared by all rooms; go-redis re-subscribes
+// the active channels when that connection is re-established.
+type RoomBus struct {
+	ps       *redis.PubSub
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.RWMutex
+	handlers map[string]func(payload []byte)
+}
+
+func roomChannel(roomID string) string {
+	return roomChannelPrefix + roomID
+}
+
+func NewRoomBus() *RoomBus {
+	busCtx, cancel := context.WithCancel(context.Background())
+	b := &RoomBus{
+		ps:       Rdb.Subscribe(busCtx),
+		ctx:      busCtx,
+		cancel:   cancel,
+		handlers: make(map[string]func(payload []byte)),
+	}
+	go b.receive()
+	return b
+}
+
+func (b *RoomBus) Publish(roomID string, payload []byte) error {
+	return Rdb.Publish(ctx, roomChannel(roomID), payload).Err()
+}
+
+func (b *RoomBus) Subscribe(roomID string, handler func(payload []byte)) error {
+	b.mu.Lock()
+	b.handlers[roomID] = handler
+	b.mu.Unlock()
+	if err := b.ps.Subscribe(b.ctx, roomChannel(roomID)); err != nil {
+		log.Log.Errorf("redis subscribe failed: room=%s, err=%v", roomID, err)
+		return err
+	}
+	log.Log.Infof("redis subscribed: room=%s", roomID)
+	return nil
+}
+
+func (b *RoomBus) Unsubscribe(roomID string) error {
+	b.mu.Lock()
+	delete(b.handlers, roomID)
+	b.mu.Unlock()
+	if err := b.ps.Unsubscribe(b.ctx, roomChannel(roomID)); err != nil {
+		log.Log.Errorf("redis unsubscribe failed: room=%s, err=%v", roomID, err)
+		return err
+	}
+	log.Log.Infof("redis unsubscribed: room=%s", roomID)
+	return nil
+}
+
+func (b *RoomBus) Close() error {
+	b.cancel()
+	return b.ps.Close()
+}
+
+func (b *RoomBus) receive() {
+	backoff := 100 * time.Millisecond
+	for {
+		msg, err := b.ps.Receive(b.ctx)
+		if err != nil {
+			if b.ctx.Err() != nil {
+				return // closed
+			}
+			// the next Receive reconnects and re-subscribes, back off while Redis is down
+			log.Log.Warnf("redis pubsub receive failed, retrying in %v: %v", backoff, err)
+			time.Sleep(backoff)
+			if backoff < 5*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = 100 * time.Millisecond
+
+		switch m := msg.(type) {
+		case *redis.Message:
+			roomID := strings.TrimPrefix(m.Channel, roomChannelPrefix)
+			b.mu.RLock()
+			handler := b.handlers[roomID]
+			b.mu.RUnlock()
+			if handler != nil {
+				handler([]byte(m.Payload))
+			}
+		case *redis.Subscription:
+			log.Log.Debugf("redis pubsub %s: %s (%d)", m.Kind, m.Channel, m.Count)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package redis
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"chatroom-api/utils"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Message search is an inverted index per room, one sorted set per token scored by the
+// message time (ULID milliseconds), so a search is an intersection of the query tokens
+// limited to a score range:
+//
+//	search:<room_id>:t:<token>   -> zset: message_id, ms
+//	search:<room_id>:s:<sender>  -> zset: message_id, ms (sender filter)
+//	search:<room_id>:keys        -> set of the keys above, to drop the room index
+//
+// Words are lower-cased, CJK text has no spaces and is indexed as single characters and
+// bigrams instead.
+const (
+	maxTokenLength    = 64
+	maxMessageTokens  = 256
+	maxQueryTokens    = 10
+	searchTempTTL     = 10 * time.Second
+	searchKeysMaxScan = 500
+)
+
+var ErrSearchCursorInvalid = errors.New("invalid search cursor")
+
+func searchTokenKey(roomID, token string) string {
+	return "search:" + roomID + ":t:" + token
+}
+
+func searchSenderKey(roomID, sender string) string {
+	return "search:" + roomID + ":s:" + sender
+}
+
+func searchKeysKey(roomID string) string {
+	return "search:" + roomID + ":keys"
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// tokenize splits text into index tokens. With query set, CJK runs of two or more
+// characters only produce their bigrams, which the index always contains.
+func tokenize(text string, query bool) []string {
+	var tokens []string
+	seen := map[string]bool{}
+	add := func(t string) {
+		if t != "" && len(t) <= maxTokenLength && !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		add(string(word))
+		word = word[:0]
+	}
+	flushCJK := func() {
+		for i, r := range cjk {
+			if !query || len(cjk) == 1 {
+				add(string(r))
+			}
+			if i+1 < len(cjk) {
+				add(string(cjk[i : i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+// QueryTokens returns the tokens a search for q has to match, at most maxQueryTokens.
+func QueryTokens(q string) []string {
+	tokens := tokenize(q, true)
+	if len(tokens) > maxQueryTokens {
+		tokens = tokens[:maxQueryTokens]
+	}
+	return tokens
+}
+
+func messageScore(messageID string) float64 {
+	t, ok := utils.ULIDTime(messageID)
+	if !ok {
+		return 0
+	}
+	return float64(t.UnixMilli())
+}
+
+func indexMessage(pipe redis.Pipeliner, msg models.Message) {
+	tokens := tokenize(msg.Text, false)
+	if len(tokens) > maxMessageTokens {
+		tokens = tokens[:maxMessageTokens]
+	}
+	z := redis.Z{Score: messageScore(msg.MessageID), Member: msg.MessageID}
+	keys := []interface{}{searchSenderKey(msg.RoomID, msg.Sender)}
+	pipe.ZAdd(ctx, searchSenderKey(msg.RoomID, msg.Sender), z)
+	for _, t := range tokens {
+		pipe.ZAdd(ctx, searchTokenKey(msg.RoomID, t), z)
+		keys = append(keys, searchTokenKey(msg.RoomID, t))
+	}
+	pipe.SAdd(ctx, searchKeysKey(msg.RoomID), keys...)
+}
+
+func unindexMessage(pipe redis.Pipeliner, msg models.Message) {
+	for _, t := range tokenize(msg.Text, false) {
+		pipe.ZRem(ctx, searchTokenKey(msg.RoomID, t), msg.MessageID)
+	}
+}
+
+// IndexMessage adds a new message to the search index.
+func IndexMessage(msg models.Message) error {
+	pipe := Rdb.Pipeline()
+	indexMessage(pipe, msg)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("index message failed: room=%s, message=%s, err=%v", msg.RoomID, msg.MessageID, err)
+		return err
+	}
+	return nil
+}
+
+// IndexMessages adds stored messages to the search index in one round trip, e.g. to backfill
+// it. Indexing a message again changes nothing, deleted messages are skipped.
+// Returns how many messages were indexed.
+func IndexMessages(msgs []models.Message) (int, error) {
+	pipe := Rdb.Pipeline()
+	n := 0
+	for _, msg := range msgs {
+		if !msg.Deleted {
+			indexMessage(pipe, msg)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("index messages failed: %v", err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// ReindexMessage replaces the tokens of old (the version before an edit) with those of msg.
+// A deleted message has no text left and drops out of the index.
+func ReindexMessage(old, msg models.Message) error {
+	pipe := Rdb.TxPipeline()
+	unindexMessage(pipe, old)
+	if msg.Deleted {
+		pipe.ZRem(ctx, searchSenderKey(msg.RoomID, msg.Sender), msg.MessageID)
+	} else {
+		indexMessage(pipe, msg)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("reindex message failed: room=%s, message=%s, err=%v", msg.RoomID, msg.MessageID, err)
+		return err
+	}
+	return nil
+}
+
+// DeleteSearchIndex drops the whole index of a room.
+func DeleteSearchIndex(roomID string) error {
+	var cursor uint64
+	for {
+		keys, next, err := Rdb.SScan(ctx, searchKeysKey(roomID), cursor, "", searchKeysMaxScan).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := Rdb.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	return Rdb.Del(ctx, searchKeysKey(roomID)).Err()
+}
+
+// SearchQuery: all Tokens must match. From and To bound the message time, zero for no bound.
+// After continues a previous search, see SearchHit.Cursor.
+type SearchQuery struct {
+	RoomIDs []string
+	Tokens  []string
+	Sender  string
+	From    time.Time
+	To      time.Time
+	After   string
+	Limit   int
+}
+
+type SearchHit struct {
+	RoomID    string
+	MessageID string
+	score     float64
+}
+
+// Cursor identifies the position of the hit in the result order (newest first).
+func (h SearchHit) Cursor() string {
+	return strconv.FormatFloat(h.score, 'f', 0, 64) + ":" + h.MessageID
+}
+
+func parseSearchCursor(cursor string) (float64, string, bool) {
+	ms, id, ok := strings.Cut(cursor, ":")
+	if !ok {
+		return 0, "", false
+	}
+	score, err := strconv.ParseFloat(ms, 64)
+	return score, id, err == nil
+}
+
+// SearchMessages returns up to Limit hits, newest first, and whether there are more.
+// Every room is intersected in the same pipeline.
+func SearchMessages(q SearchQuery) ([]SearchHit, bool, error) {
+	if len(q.Tokens) == 0 || len(q.RoomIDs) == 0 {
+		return nil, false, nil
+	}
+	lo, hi := "-inf", "+inf"
+	if !q.From.IsZero() {
+		lo = strconv.FormatInt(q.From.UnixMilli(), 10)
+	}
+	if !q.To.IsZero() {
+		hi = strconv.FormatInt(q.To.UnixMilli(), 10)
+	}
+	afterScore, afterID := 0.0, ""
+	if q.After != "" {
+		var ok bool
+		if afterScore, afterID, ok = parseSearchCursor(q.After); !ok {
+			return nil, false, ErrSearchCursorInvalid
+		}
+		if q.To.IsZero() || afterScore < float64(q.To.UnixMilli()) {
+			hi = strconv.FormatFloat(afterScore, 'f', 0, 64)
+		}
+	}
+
+	tmp := "search:tmp:" + randomHex(8) + ":"
+	pipe := Rdb.Pipeline()
+	ranges := make([]*redis.ZSliceCmd, len(q.RoomIDs))
+	for i, roomID := range q.RoomIDs {
+		keys := make([]string, 0, len(q.Tokens)+1)
+		for _, t := range q.Tokens {
+			keys = append(keys, searchTokenKey(roomID, t))
+		}
+		if q.Sender != "" {
+			keys = append(keys, searchSenderKey(roomID, q.Sender))
+		}
+		dest := tmp + roomID
+		pipe.ZInterStore(ctx, dest, &redis.ZStore{Keys: keys, Aggregate: "MAX"})
+		pipe.Expire(ctx, dest, searchTempTTL)
+		// Start/Stop are min/max, go-redis swaps them for Rev. Hits on the cursor's millisecond
+		// may already have been returned, so fetch some extra.
+		ranges[i] = pipe.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+			Key: dest, Start: lo, Stop: hi, ByScore: true, Rev: true, Count: int64(q.Limit + 16),
+		})
+		pipe.Del(ctx, dest)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("search failed: %v", err)
+		return nil, false, err
+	}
+
+	var hits []SearchHit
+	for i, roomID := range q.RoomIDs {
+		for _, z := range ranges[i].Val() {
+			id, _ := z.Member.(string)
+			if afterID != "" && z.Score == afterScore && id >= afterID {
+				continue
+			}
+			hits = append(hits, SearchHit{RoomID: roomID, MessageID: id, score: z.Score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].MessageID > hits[j].MessageID
+	})
+	more := len(hits) > q.Limit
+	if more {
+		hits = hits[:q.Limit]
+	}
+	return hits, more, nil
+}
@@ -0,0 +1,28 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		text  string
+		query bool
+		want  []string
+	}{
+		{"Deploy the API, deploy v2!", false, []string{"deploy", "the", "api", "v2"}},
+		{"東京都", false, []string{"東", "東京", "京", "京都", "都"}},
+		{"東京都", true, []string{"東京", "京都"}},
+		{"東", true, []string{"東"}},
+		{"go言語", true, []string{"go", "言語"}},
+	}
+	for _, c := range cases {
+		if got := tokenize(c.text, c.query); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("tokenize(%q, %v) = %q, want %q", c.text, c.query, got, c.want)
+		}
+	}
+	if got := QueryTokens("a b c d e f g h i j k l m n o p q r s t u v w x y z"); len(got) != maxQueryTokens {
+		t.Errorf("QueryTokens kept %d tokens, want %d", len(got), maxQueryTokens)
+	}
+}
@@ -0,0 +1,238 @@
+package redis
+
+import (
+	log "chatroom-api/logger"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// A session is one login. It owns the current access token and a family of refresh tokens.
+//
+//	token:<jwt>           -> username, expires with the access token
+//	sessions:<username>   -> hash: session id -> current access token
+//	refresh:<token>       -> hash: username, session, used
+//
+// Removing a session from the index invalidates every refresh token of its family.
+const RefreshTokenTTL = 7 * 24 * time.Hour
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+)
+
+type Session struct {
+	SessionID string `json:"session_id"`
+	ExpiresIn int64  `json:"expires_in"` // seconds until the current access token expires
+}
+
+func tokenKey(token string) string {
+	return "token:" + token
+}
+
+func sessionIndexKey(username string) string {
+	return "sessions:" + username
+}
+
+func refreshKey(refreshToken string) string {
+	return "refresh:" + refreshToken
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func NewSessionID() string {
+	return randomHex(8)
+}
+
+func NewRefreshToken() string {
+	return randomHex(32)
+}
+
+// Replaces the access token of a session in one step, so concurrent logins or refreshes
+// of the same session never leave the token of the loser behind. A rotation (ARGV[6] = 1)
+// is refused when the session was revoked in the meantime, it must not be brought back.
+// KEYS: sessions index, new token key. ARGV: session id, username, token, ttl ms, index ttl s, rotate.
+var saveSessionScript = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[1], ARGV[1])
+if previous then
+	redis.call('DEL', 'token:' .. previous)
+elseif ARGV[6] == '1' then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[2], 'PX', ARGV[4])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+return 1
+`)
+
+func saveSession(username, sessionID, token string, ttl time.Duration, rotate bool) error {
+	keys := []string{sessionIndexKey(username), tokenKey(token)}
+	flag := 0
+	if rotate {
+		flag = 1
+	}
+	saved, err := saveSessionScript.Run(ctx, Rdb, keys, sessionID, username, token, ttl.Milliseconds(), int64(RefreshTokenTTL/time.Second), flag).Int()
+	if err != nil {
+		log.Log.Errorf("save session failed: user=%s, err=%v", username, err)
+		return err
+	}
+	if saved == 0 {
+		log.Log.Warnf("session revoked during refresh: user=%s, session=%s", username, sessionID)
+		return ErrRefreshTokenInvalid
+	}
+	log.Log.Infof("session saved: user=%s, session=%s", username, sessionID)
+	return nil
+}
+
+// SaveSession stores the access token of a session, replacing the previous one if any.
+func SaveSession(username, sessionID, token string, ttl time.Duration) error {
+	return saveSession(username, sessionID, token, ttl, false)
+}
+
+// RotateSession replaces the access token of an existing session. It returns
+// ErrRefreshTokenInvalid if the session was logged out or revoked.
+func RotateSession(username, sessionID, token string, ttl time.Duration) error {
+	return saveSession(username, sessionID, token, ttl, true)
+}
+
+// SessionExists reports whether the access token has not been revoked or expired.
+func SessionExists(token string) (bool, error) {
+	n, err := Rdb.Exists(ctx, tokenKey(token)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteToken revokes a single access token.
+func DeleteToken(token string) error {
+	return Rdb.Del(ctx, tokenKey(token)).Err()
+}
+
+// Removes a session and its access token in one step.
+// KEYS: sessions index. ARGV: session id.
+var deleteSessionScript = redis.NewScript(`
+local token = redis.call('HGET', KEYS[1], ARGV[1])
+if not token then
+	return 0
+end
+redis.call('DEL', 'token:' .. token)
+redis.call('HDEL', KEYS[1], ARGV[1])
+return 1
+`)
+
+// DeleteSession revokes a session and its refresh token family, returns false if it does not exist.
+func DeleteSession(username, sessionID string) (bool, error) {
+	deleted, err := deleteSessionScript.Run(ctx, Rdb, []string{sessionIndexKey(username)}, sessionID).Int()
+	if err != nil {
+		log.Log.Errorf("delete session failed: user=%s, err=%v", username, err)
+		return false, err
+	}
+	if deleted == 0 {
+		return false, nil
+	}
+	log.Log.Infof("session deleted: user=%s, session=%s", username, sessionID)
+	return true, nil
+}
+
+// ListSessions returns the sessions of a user. Sessions whose access token expired are still
+// listed (they can be refreshed) with expires_in = 0.
+func ListSessions(username string) ([]Session, error) {
+	entries, err := Rdb.HGetAll(ctx, sessionIndexKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for id, token := range entries {
+		ttl, err := Rdb.TTL(ctx, tokenKey(token)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		sessions = append(sessions, Session{SessionID: id, ExpiresIn: int64(ttl / time.Second)})
+	}
+	return sessions, nil
+}
+
+// Removes every session of a user and their access tokens in one step, returns the count.
+// KEYS: sessions index.
+var deleteAllSessionsScript = redis.NewScript(`
+local tokens = redis.call('HVALS', KEYS[1])
+for _, token in ipairs(tokens) do
+	redis.call('DEL', 'token:' .. token)
+end
+redis.call('DEL', KEYS[1])
+return #tokens
+`)
+
+// DeleteAllSessions revokes every session of a user and returns how many were removed.
+func DeleteAllSessions(username string) (int, error) {
+	count, err := deleteAllSessionsScript.Run(ctx, Rdb, []string{sessionIndexKey(username)}).Int()
+	if err != nil {
+		log.Log.Errorf("delete all sessions failed: user=%s, err=%v", username, err)
+		return 0, err
+	}
+	log.Log.Infof("all sessions deleted: user=%s, count=%d", username, count)
+	return count, nil
+}
+
+func SaveRefreshToken(username, sessionID, refreshToken string) error {
+	pipe := Rdb.TxPipeline()
+	pipe.HSet(ctx, refreshKey(refreshToken), "username", username, "session", sessionID, "used", 0)
+	pipe.Expire(ctx, refreshKey(refreshToken), RefreshTokenTTL)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Log.Errorf("save refresh token failed: user=%s, err=%v", username, err)
+	}
+	return err
+}
+
+// Marks a refresh token as used and returns its owner and whether its session still exists.
+// Used tokens are kept until they expire so that a second presentation can be detected.
+var consumeRefreshScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local used = redis.call('HINCRBY', KEYS[1], 'used', 1)
+local username = redis.call('HGET', KEYS[1], 'username')
+local session = redis.call('HGET', KEYS[1], 'session')
+return {username, session, used, redis.call('HEXISTS', 'sessions:' .. username, session)}
+`)
+
+// ConsumeRefreshToken validates a refresh token and marks it used. If the token was already
+// used, the whole session (token family) is revoked and ErrRefreshTokenReused is returned.
+// The session may still be revoked before the new tokens are saved, see RotateSession.
+func ConsumeRefreshToken(refreshToken string) (username, sessionID string, err error) {
+	res, err := consumeRefreshScript.Run(ctx, Rdb, []string{refreshKey(refreshToken)}).Slice()
+	if err == redis.Nil {
+		return "", "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+	username, _ = res[0].(string)
+	sessionID, _ = res[1].(string)
+	used, _ := res[2].(int64)
+	exists, _ := res[3].(int64)
+
+	if used > 1 {
+		log.Log.Warnf("refresh token reuse detected, revoking session: user=%s, session=%s", username, sessionID)
+		if _, err := DeleteSession(username, sessionID); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrRefreshTokenReused
+	}
+	// the session may have been logged out or revoked by an admin
+	if exists == 0 {
+		return "", "", ErrRefreshTokenInvalid
+	}
+	return username, sessionID, nil
+}
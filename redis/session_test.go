@@ -0,0 +1,146 @@
+package redis
+
+import (
+	log "chatroom-api/logger"
+	"errors"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRedis points Rdb to an in-process Redis for the test.
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	log.Log.SetOutput(io.Discard)
+	mr := miniredis.RunT(t)
+	Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return mr
+}
+
+func TestSaveSessionReplacesToken(t *testing.T) {
+	mr := newTestRedis(t)
+	if err := SaveSession("alice", "s1", "old", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveSession("alice", "s1", "new", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := SessionExists("old"); ok {
+		t.Fatal("previous access token still valid")
+	}
+	if ok, _ := SessionExists("new"); !ok {
+		t.Fatal("new access token not valid")
+	}
+	if ttl := mr.TTL(tokenKey("new")); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("token ttl = %v, want <= 1m", ttl)
+	}
+}
+
+func TestSaveSessionConcurrent(t *testing.T) {
+	mr := newTestRedis(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = SaveSession("alice", "s1", fmt.Sprintf("token-%d", i), time.Minute)
+		}(i)
+	}
+	wg.Wait()
+	var live []string
+	for _, k := range mr.Keys() {
+		if strings.HasPrefix(k, "token:") {
+			live = append(live, k)
+		}
+	}
+	current := mr.HGet(sessionIndexKey("alice"), "s1")
+	if len(live) != 1 || live[0] != tokenKey(current) {
+		t.Fatalf("live tokens = %v, want only the indexed %q", live, current)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	newTestRedis(t)
+	if err := SaveSession("alice", "s1", "access", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveRefreshToken("alice", "s1", "r1"); err != nil {
+		t.Fatal(err)
+	}
+	user, session, err := ConsumeRefreshToken("r1")
+	if err != nil || user != "alice" || session != "s1" {
+		t.Fatalf("first use = %q, %q, %v", user, session, err)
+	}
+	// the rotated token of the same family
+	if err := SaveRefreshToken("alice", "s1", "r2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ConsumeRefreshToken("r1"); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("second use: err = %v, want ErrRefreshTokenReused", err)
+	}
+	if ok, _ := SessionExists("access"); ok {
+		t.Fatal("access token survived refresh token reuse")
+	}
+	if _, _, err := ConsumeRefreshToken("r2"); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("family member after reuse: err = %v, want ErrRefreshTokenInvalid", err)
+	}
+	if _, _, err := ConsumeRefreshToken("unknown"); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("unknown token: err = %v, want ErrRefreshTokenInvalid", err)
+	}
+}
+
+func TestRefreshDuringRevoke(t *testing.T) {
+	mr := newTestRedis(t)
+	if err := SaveSession("alice", "s1", "access", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveRefreshToken("alice", "s1", "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ConsumeRefreshToken("r1"); err != nil {
+		t.Fatal(err)
+	}
+	// logged out while the refresh is issuing new tokens
+	if found, err := DeleteSession("alice", "s1"); err != nil || !found {
+		t.Fatalf("delete = %v, %v, want found", found, err)
+	}
+	if err := RotateSession("alice", "s1", "rotated", time.Minute); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("rotate after revoke: err = %v, want ErrRefreshTokenInvalid", err)
+	}
+	if ok, _ := SessionExists("rotated"); ok || mr.Exists(sessionIndexKey("alice")) {
+		t.Fatal("the revoked session came back")
+	}
+	// a refresh token saved after the revoke is of no use
+	if err := SaveRefreshToken("alice", "s1", "r2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ConsumeRefreshToken("r2"); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("refresh token of a revoked session: err = %v, want ErrRefreshTokenInvalid", err)
+	}
+	if found, _ := DeleteSession("alice", "s1"); found {
+		t.Fatal("deleted the session twice")
+	}
+}
+
+func TestDeleteAllSessions(t *testing.T) {
+	newTestRedis(t)
+	for _, s := range []string{"s1", "s2"} {
+		if err := SaveSession("alice", s, "access-"+s, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := DeleteAllSessions("alice"); err != nil || n != 2 {
+		t.Fatalf("delete all = %d, %v, want 2", n, err)
+	}
+	if ok, _ := SessionExists("access-s2"); ok {
+		t.Fatal("access token survived")
+	}
+	if err := RotateSession("alice", "s1", "rotated", time.Minute); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Fatalf("rotate after delete all: err = %v, want ErrRefreshTokenInvalid", err)
+	}
+}
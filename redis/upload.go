@@ -0,0 +1,118 @@
+package redis
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// Uploads wait here until a message claims them:
+//
+//	upload:<attachment_id>  -> attachment JSON, expires after PendingUploadTTL
+//	upload_expiry           -> sorted set of blob keys ("<room_id>/<attachment_id>") by expiry, unix seconds
+//
+// Unclaimed blobs are deleted by SweepPendingUploads.
+const (
+	PendingUploadTTL = 24 * time.Hour
+	uploadExpiryKey  = "upload_expiry"
+	// uploadSweepGrace keeps a blob a little longer than its entry, a claim racing the
+	// expiry never gets an attachment whose file is already gone
+	uploadSweepGrace = 5 * time.Minute
+)
+
+var ErrUploadNotFound = errors.New("upload does not exist or expired")
+
+func uploadKey(attachmentID string) string {
+	return "upload:" + attachmentID
+}
+
+func uploadExpiry(a models.Attachment) time.Time {
+	uploaded, err := time.Parse(time.RFC3339, a.UploadedAt)
+	if err != nil {
+		uploaded = time.Now()
+	}
+	return uploaded.Add(PendingUploadTTL)
+}
+
+// savePendingUpload writes the entry of a and schedules its blob for the sweep.
+// An upload past its expiry only gets scheduled.
+func savePendingUpload(pipe redis.Pipeliner, a models.Attachment) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	expires := uploadExpiry(a)
+	if ttl := time.Until(expires); ttl > 0 {
+		pipe.Set(ctx, uploadKey(a.AttachmentID), data, ttl)
+	}
+	pipe.ZAdd(ctx, uploadExpiryKey, redis.Z{Score: float64(expires.Add(uploadSweepGrace).Unix()), Member: a.BlobKey()})
+	return nil
+}
+
+// SavePendingUpload keeps a claimable until PendingUploadTTL after a.UploadedAt.
+func SavePendingUpload(a models.Attachment) error {
+	pipe := Rdb.TxPipeline()
+	if err := savePendingUpload(pipe, a); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// claimUploadScript takes the entry KEYS[1] and, only if it existed, unschedules its blob ARGV[1]
+// from KEYS[2]: a failed claim of an expired upload leaves the blob to the sweep.
+var claimUploadScript = redis.NewScript(`
+local data = redis.call('GETDEL', KEYS[1])
+if data then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+end
+return data
+`)
+
+// ClaimPendingUpload takes the upload attachmentID of room roomID, so only one message can
+// carry it. The entry and its sweep are removed in one step; give it back with
+// RestorePendingUploads if the upload turns out unusable or the message is not saved.
+func ClaimPendingUpload(roomID, attachmentID string) (models.Attachment, error) {
+	var a models.Attachment
+	data, err := claimUploadScript.Run(ctx, Rdb, []string{uploadKey(attachmentID), uploadExpiryKey}, roomID+"/"+attachmentID).Text()
+	if err == redis.Nil {
+		return a, ErrUploadNotFound
+	}
+	if err != nil {
+		return a, err
+	}
+	err = json.Unmarshal([]byte(data), &a)
+	return a, err
+}
+
+// RestorePendingUploads puts claimed uploads back, with the expiry they had.
+func RestorePendingUploads(attachments ...models.Attachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	pipe := Rdb.TxPipeline()
+	for _, a := range attachments {
+		if err := savePendingUpload(pipe, a); err != nil {
+			return err
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Log.Errorf("restore pending uploads failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SweepPendingUploads returns the blob keys of uploads no message claimed in time, at most
+// limit. They are handed out once, the caller deletes the blobs.
+func SweepPendingUploads(limit int) ([]string, error) {
+	keys, err := claimExpiredScript.Run(ctx, Rdb, []string{uploadExpiryKey}, time.Now().Unix(), limit).StringSlice()
+	if err != nil {
+		log.Log.Errorf("sweep pending uploads failed: %v", err)
+		return nil, err
+	}
+	return keys, nil
+}
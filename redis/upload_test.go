@@ -0,0 +1,65 @@
+package redis
+
+import (
+	"chatroom-api/models"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClaimPendingUpload(t *testing.T) {
+	newTestRedis(t)
+	a := models.Attachment{AttachmentID: "a1", RoomID: "r1", UploadedBy: "alice", UploadedAt: time.Now().Format(time.RFC3339)}
+	if err := SavePendingUpload(a); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ClaimPendingUpload("r1", "a1")
+	if err != nil || got.UploadedBy != "alice" {
+		t.Fatalf("claim = %v, %v, want the upload", got, err)
+	}
+	if _, err := ClaimPendingUpload("r1", "a1"); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("second claim: err = %v, want ErrUploadNotFound", err)
+	}
+	if err := RestorePendingUploads(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClaimPendingUpload("r1", "a1"); err != nil {
+		t.Fatalf("claim after restore: %v", err)
+	}
+}
+
+func TestSweepPendingUploads(t *testing.T) {
+	mr := newTestRedis(t)
+	now := time.Now()
+	expired := models.Attachment{AttachmentID: "expired", RoomID: "r1", UploadedAt: now.Add(-PendingUploadTTL - time.Hour).Format(time.RFC3339)}
+	claimed := models.Attachment{AttachmentID: "claimed", RoomID: "r1", UploadedAt: expired.UploadedAt}
+	fresh := models.Attachment{AttachmentID: "fresh", RoomID: "r1", UploadedAt: now.Format(time.RFC3339)}
+	for _, a := range []models.Attachment{expired, fresh} {
+		if err := SavePendingUpload(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// restoring after the expiry, e.g. when saving the message failed, only schedules the blob
+	if err := RestorePendingUploads(claimed); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(uploadKey("expired")) || mr.Exists(uploadKey("claimed")) {
+		t.Fatal("an upload past its expiry is claimable")
+	}
+	// a failed claim leaves the blob to the sweep
+	if _, err := ClaimPendingUpload("r1", "expired"); !errors.Is(err, ErrUploadNotFound) {
+		t.Fatalf("claim of an expired upload: err = %v, want ErrUploadNotFound", err)
+	}
+
+	keys, err := SweepPendingUploads(10)
+	if err != nil || !reflect.DeepEqual(keys, []string{"r1/claimed", "r1/expired"}) {
+		t.Fatalf("sweep = %v, %v, want r1/claimed, r1/expired", keys, err)
+	}
+	if keys, _ := SweepPendingUploads(10); len(keys) != 0 {
+		t.Fatalf("second sweep = %v, want nothing", keys)
+	}
+	if _, err := ClaimPendingUpload("r1", "fresh"); err != nil {
+		t.Fatalf("claim of the fresh upload: %v", err)
+	}
+}
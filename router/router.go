@@ -1,46 +1,126 @@
 package router
 
 import (
+	"chatroom-api/authz"
 	"chatroom-api/handlers"
 	log "chatroom-api/logger"
 	"chatroom-api/middleware"
+	"fmt"
 	"github.com/gin-contrib/cors" // CORS middleware
 	"github.com/gin-gonic/gin"
+	"net/url"
+	"strings"
 	"time"
 )
 
+// accessLogFormatter is gin's default access log line with credentials removed from the query.
+func accessLogFormatter(p gin.LogFormatterParams) string {
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		p.TimeStamp.Format("2006/01/02 - 15:04:05"), p.StatusCode, p.Latency, p.ClientIP, p.Method, redactQuery(p.Path), p.ErrorMessage)
+}
+
+// redactQuery hides the WebSocket ?token= and the signature of attachment links.
+func redactQuery(path string) string {
+	base, query, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return base + "?<unparsable>"
+	}
+	for _, key := range []string{"token", "sig"} {
+		if values.Has(key) {
+			values.Set(key, "REDACTED")
+		}
+	}
+	return base + "?" + values.Encode()
+}
+
 // SetupRouter
 func SetupRouter() *gin.Engine {
 	log.Log.Info("Initialize the routing engine.")
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(accessLogFormatter), gin.Recovery())
 
 	// CORS middleware
 	log.Log.Info("enable CORS")
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", middleware.ImpersonateHeader},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 	api := r.Group("/api")
 	// register API
-	log.Log.Info("register public API: /register, /login")
+	log.Log.Info("register public API: /register, /login, /token/refresh, /files")
 	api.POST("/register", handlers.Register)
 	api.POST("/login", handlers.Login)
+	api.POST("/token/refresh", handlers.RefreshToken)
 	api.GET("/health", handlers.HealthCheck)
+	// attachment downloads are authorized by the signed link, see handlers.DownloadAttachment
+	api.GET("/files/:roomId/:attachmentId", handlers.DownloadAttachment)
 
 	log.Log.Info("Register protected API group (requires authentication)")
 	auth := api.Group("/")
-	auth.Use(middleware.AuthMiddleware())
+	auth.Use(middleware.AuthMiddleware(), middleware.Impersonation())
+
+	auth.POST("/logout", handlers.Logout)
+	auth.POST("/logout/all", handlers.LogoutAll)
 
+	auth.GET("/chatrooms", handlers.ListPublicChatrooms)
 	auth.POST("/chatrooms", handlers.CreateChatroom)
 	auth.POST("/chatrooms/join", handlers.JoinChatroom)
 	auth.POST("/chatrooms/exit", handlers.ExitChatroom)
 	auth.GET("/chatrooms/user/:username", handlers.GetUserChatrooms)
-	auth.GET("/chatrooms/:roomId", handlers.GetChatroomByRoomID)
-	auth.GET("/messages/:roomId", handlers.GetChatroomMessages)
-	auth.GET("/chatrooms/:roomId/enter", handlers.EnterChatRoom)
+	auth.POST("/dm/:username", handlers.OpenDirectMessage)
+	auth.GET("/users/:username/presence", handlers.GetUserPresence)
+	auth.GET("/search/messages", handlers.SearchMessages)
+	// room-scoped endpoints go through the central room authorization
+	canRead := middleware.RoomAccess(authz.ReadRoom)
+	canPost := middleware.RoomAccess(authz.PostMessage)
+	auth.GET("/chatrooms/:roomId", canRead, handlers.GetChatroomByRoomID)
+	auth.PATCH("/chatrooms/:roomId", middleware.RoomAccess(authz.UpdateRoom), handlers.UpdateChatroom)
+	auth.DELETE("/chatrooms/:roomId", middleware.RoomAccess(authz.DeleteRoom), handlers.DeleteChatroom)
+	auth.GET("/messages/:roomId", canRead, handlers.GetChatroomMessages)
+	auth.POST("/messages/:roomId", canPost, handlers.PostChatroomMessage)
+	auth.GET("/chatrooms/:roomId/enter", canRead, handlers.EnterChatRoom)
+	auth.GET("/chatrooms/:roomId/online", canRead, handlers.GetOnlineMembers)
+	// read receipts are kept and shown for members only
+	auth.POST("/chatrooms/:roomId/read", canPost, handlers.MarkChatroomRead)
+	auth.GET("/chatrooms/:roomId/read/:messageId", canPost, handlers.GetMessageReaders)
+	auth.GET("/messages/:roomId/:messageId/thread", canRead, handlers.GetThreadMessages)
+	// senders change their own messages, moderators anyone's (checked in the handlers)
+	auth.PATCH("/messages/:roomId/:messageId", canPost, handlers.EditChatroomMessage)
+	auth.DELETE("/messages/:roomId/:messageId", canPost, handlers.DeleteChatroomMessage)
+	auth.PUT("/messages/:roomId/:messageId/reactions/:emoji", canPost, handlers.AddReaction)
+	auth.DELETE("/messages/:roomId/:messageId/reactions/:emoji", canPost, handlers.RemoveReaction)
+	auth.POST("/messages/:roomId/attachments", canPost, handlers.UploadAttachment)
+	auth.GET("/messages/:roomId/:messageId/attachments/:attachmentId", canRead, handlers.GetAttachmentURL)
+	auth.GET("/messages/:roomId/:messageId/revisions", middleware.RoomAccess(authz.ModerateMessages), handlers.GetMessageRevisions)
+
+	// room roles: finer checks against the target member happen in the handlers
+	auth.GET("/chatrooms/:roomId/members", canRead, handlers.ListMembers)
+	auth.PUT("/chatrooms/:roomId/members/:username/role", middleware.RoomAccess(authz.ManageRoles), handlers.SetMemberRole)
+	auth.POST("/chatrooms/:roomId/members/:username/kick", middleware.RoomAccess(authz.KickMember), handlers.KickMember)
+	auth.POST("/chatrooms/:roomId/transfer", middleware.RoomAccess(authz.TransferOwnership), handlers.TransferOwnership)
+
+	canManageInvites := middleware.RoomAccess(authz.ManageInvites)
+	auth.POST("/chatrooms/:roomId/invites", canManageInvites, handlers.CreateInvite)
+	auth.GET("/chatrooms/:roomId/invites", canManageInvites, handlers.ListInvites)
+	auth.DELETE("/chatrooms/:roomId/invites/:code", canManageInvites, handlers.RevokeInvite)
+
+	log.Log.Info("Register WebSocket endpoint: /ws/:roomId")
+	r.GET("/ws/:roomId", middleware.WSAuthMiddleware(), middleware.Impersonation(), middleware.RoomAccess(authz.ReadRoom), handlers.ServeWS)
+
+	log.Log.Info("Register admin API group")
+	admin := auth.Group("/admin")
+	admin.Use(middleware.AdminMiddleware())
+	admin.GET("/users/:username/sessions", handlers.ListUserSessions)
+	admin.DELETE("/users/:username/sessions", handlers.RevokeAllUserSessions)
+	admin.DELETE("/users/:username/sessions/:sessionId", handlers.RevokeUserSession)
+	admin.GET("/audit/impersonation", handlers.ListImpersonationAudit)
 
 	log.Log.Info("All routes have been registered.")
 	return r
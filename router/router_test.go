@@ -0,0 +1,17 @@
+package router
+
+import "testing"
+
+func TestRedactQuery(t *testing.T) {
+	cases := map[string]string{
+		"/api/chatrooms":                       "/api/chatrooms",
+		"/ws/r1?token=eyJhbGciOi":              "/ws/r1?token=REDACTED",
+		"/api/files/r1/a1?exp=1&sig=abc&u=bob": "/api/files/r1/a1?exp=1&sig=REDACTED&u=bob",
+		"/api/search/messages?q=deploy":        "/api/search/messages?q=deploy",
+	}
+	for in, want := range cases {
+		if got := redactQuery(in); got != want {
+			t.Errorf("redactQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
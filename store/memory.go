@@ -0,0 +1,630 @@
+package store
+
+import (
+	log "chatroom-api/logger"
+	"chatroom-api/models"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in process memory. Used for local runs and tests, data is lost on restart.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	users     map[string]models.User
+	chatrooms map[string]models.Chatroom
+	messages  map[string][]models.Message           // room_id -> messages sorted by message_id
+	revisions map[string][]models.MessageRevision   // room_id -> revisions in creation order
+	reactions map[string]map[string]models.Reaction // room_id -> reaction_key -> reaction
+	invites   map[string]models.Invite
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[string]models.User),
+		chatrooms: make(map[string]models.Chatroom),
+		messages:  make(map[string][]models.Message),
+		revisions: make(map[string][]models.MessageRevision),
+		reactions: make(map[string]map[string]models.Reaction),
+		invites:   make(map[string]models.Invite),
+	}
+}
+
+func (s *MemoryStore) CreateUser(user models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user.Username]; ok {
+		log.Log.Warnf("User creation failed: username=%s already exists", user.Username)
+		return ErrUserExists
+	}
+	s.users[user.Username] = user
+	log.Log.Infof("User created successfully: username=%s", user.Username)
+	return nil
+}
+
+func (s *MemoryStore) GetUserByUsername(username string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[username]
+	if !ok {
+		log.Log.Warnf("user not exist: username=%s", username)
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (s *MemoryStore) UpdateUserPassword(username, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.Password = password
+	s.users[username] = user
+	return nil
+}
+
+func (s *MemoryStore) CreateChatroom(chatroom models.Chatroom) error {
+	if chatroom.CreatedAt == "" {
+		chatroom.CreatedAt = time.Now().Format(time.RFC3339)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.chatrooms[chatroom.RoomID]; ok {
+		return ErrChatroomExists
+	}
+	chatroom.Users = append([]string(nil), chatroom.Users...)
+	chatroom.JoinedAt = make(map[string]string, len(chatroom.Users))
+	for _, u := range chatroom.Users {
+		chatroom.JoinedAt[u] = chatroom.CreatedAt
+	}
+	s.chatrooms[chatroom.RoomID] = chatroom
+	log.Log.Infof("Chatroom created successfully: room_id=%s", chatroom.RoomID)
+	return nil
+}
+
+func (s *MemoryStore) GetChatroom(roomID string) (models.Chatroom, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chatroom, ok := s.chatrooms[roomID]
+	if !ok {
+		log.Log.Warnf("can not find chatroom: room_id=%s", roomID)
+		return models.Chatroom{}, ErrChatroomNotFound
+	}
+	return roomItem(chatroom), nil
+}
+
+// roomItem drops the members of a stored room, like the DynamoDB room item.
+func roomItem(chatroom models.Chatroom) models.Chatroom {
+	chatroom.MemberCount = len(chatroom.Users)
+	chatroom.Users = nil
+	chatroom.Roles = nil
+	chatroom.LastRead = nil
+	chatroom.JoinedAt = nil
+	return chatroom
+}
+
+func memberOf(chatroom models.Chatroom, username string) models.Member {
+	return models.Member{
+		RoomID:     chatroom.RoomID,
+		Username:   username,
+		Role:       chatroom.Roles[username],
+		JoinedAt:   chatroom.JoinedAt[username],
+		LastReadID: chatroom.LastRead[username],
+	}
+}
+
+func (s *MemoryStore) GetMember(roomID, username string) (models.Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chatroom, ok := s.chatrooms[roomID]
+	if !ok || !isMember(chatroom, username) {
+		return models.Member{}, ErrNotMember
+	}
+	return memberOf(chatroom, username), nil
+}
+
+func (s *MemoryStore) ListMembers(roomID string) ([]models.Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chatroom := s.chatrooms[roomID]
+	members := make([]models.Member, 0, len(chatroom.Users))
+	for _, u := range chatroom.Users {
+		members = append(members, memberOf(chatroom, u))
+	}
+	return members, nil
+}
+
+func (s *MemoryStore) AddUserToChatroom(username, roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chatroom, ok := s.chatrooms[roomID]
+	if !ok {
+		return ErrChatroomNotFound
+	}
+	for _, u := range chatroom.Users {
+		if u == username {
+			return nil
+		}
+	}
+	chatroom.Users = append(chatroom.Users, username)
+	chatroom.JoinedAt = copyRoles(chatroom.JoinedAt)
+	chatroom.JoinedAt[username] = time.Now().Format(time.RFC3339)
+	chatroom.Version++ // like the DynamoDB member_count update
+	s.chatrooms[roomID] = chatroom
+	log.Log.Infof("add user into chatroom successfully: user=%s, room=%s", username, roomID)
+	return nil
+}
+
+func (s *MemoryStore) RemoveUserFromChatroom(username, roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chatroom, ok := s.chatrooms[roomID]
+	if !ok {
+		return ErrChatroomNotFound
+	}
+	var newUsers []string
+	for _, u := range chatroom.Users {
+		if u != username {
+			newUsers = append(newUsers, u)
+		}
+	}
+	if len(newUsers) < len(chatroom.Users) {
+		chatroom.Version++
+	}
+	chatroom.Users = newUsers
+	chatroom.Roles = copyRoles(chatroom.Roles)
+	delete(chatroom.Roles, username)
+	chatroom.LastRead = copyRoles(chatroom.LastRead)
+	delete(chatroom.LastRead, username)
+	chatroom.JoinedAt = copyRoles(chatroom.JoinedAt)
+	delete(chatroom.JoinedAt, username)
+	s.chatrooms[roomID] = chatroom
+	log.Log.Infof("remove successfully: user=%s, room=%s", username, roomID)
+	return nil
+}
+
+// UpdateChatroom runs update under the store lock, so it never conflicts.
+// Members are not part of the room item and are kept as they are.
+func (s *MemoryStore) UpdateChatroom(roomID string, update func(*models.Chatroom) error) (models.Chatroom, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.chatrooms[roomID]
+	if !ok {
+		return models.Chatroom{}, ErrChatroomNotFound
+	}
+	chatroom := current
+	chatroom.Users = append([]string(nil), current.Users...)
+	chatroom.Roles = copyRoles(current.Roles)
+	if err := update(&chatroom); err != nil {
+		return models.Chatroom{}, err
+	}
+	chatroom.RoomID = roomID
+	chatroom.Users = current.Users
+	chatroom.Roles = current.Roles
+	chatroom.LastRead = current.LastRead
+	chatroom.JoinedAt = current.JoinedAt
+	chatroom.Version = current.Version + 1
+	s.chatrooms[roomID] = chatroom
+	return roomItem(chatroom), nil
+}
+
+func (s *MemoryStore) DeleteChatroom(roomID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.chatrooms[roomID]; !ok {
+		return ErrChatroomNotFound
+	}
+	delete(s.chatrooms, roomID)
+	delete(s.messages, roomID)
+	delete(s.revisions, roomID)
+	delete(s.reactions, roomID)
+	for code, invite := range s.invites {
+		if invite.RoomID == roomID {
+			delete(s.invites, code)
+		}
+	}
+	return nil
+}
+
+func copyRoles(roles map[string]string) map[string]string {
+	out := make(map[string]string, len(roles))
+	for k, v := range roles {
+		out[k] = v
+	}
+	return out
+}
+
+func isMember(chatroom models.Chatroom, username string) bool {
+	for _, u := range chatroom.Users {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) SetMemberRole(roomID, username, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chatroom, ok := s.chatrooms[roomID]
+	if !ok {
+		return ErrChatroomNotFound
+	}
+	if !isMember(chatroom, username) {
+		return ErrNotMember
+	}
+	chatroom.Roles = copyRoles(chatroom.Roles)
+	if role == "member" {
+		delete(chatroom.Roles, username)
+	} else {
+		chatroom.Roles[username] = role
+	}
+	s.chatrooms[roomID] = chatroom
+	return nil
+}
+
+func (s *MemoryStore) MarkRead(roomID, username, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chatroom, ok := s.chatrooms[roomID]
+	if !ok {
+		return ErrChatroomNotFound
+	}
+	if !isMember(chatroom, username) {
+		return ErrNotMember
+	}
+	if messageID <= chatroom.LastRead[username] {
+		return nil
+	}
+	chatroom.LastRead = copyRoles(chatroom.LastRead)
+	chatroom.LastRead[username] = messageID
+	s.chatrooms[roomID] = chatroom
+	return nil
+}
+
+func (s *MemoryStore) TransferOwnership(roomID, from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chatroom, ok := s.chatrooms[roomID]
+	if !ok {
+		return ErrChatroomNotFound
+	}
+	if !isMember(chatroom, to) {
+		return ErrNotMember
+	}
+	if chatroom.Roles[from] != "owner" {
+		return ErrConflict
+	}
+	chatroom.Roles = copyRoles(chatroom.Roles)
+	chatroom.Roles[from] = "admin"
+	chatroom.Roles[to] = "owner"
+	s.chatrooms[roomID] = chatroom
+	return nil
+}
+
+func (s *MemoryStore) GetChatroomsByUsername(username string) ([]models.Chatroom, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []models.Chatroom
+	for _, room := range s.chatrooms {
+		for _, u := range room.Users {
+			if u == username {
+				member := memberOf(room, username)
+				room = roomItem(room)
+				room.AddMember(member)
+				results = append(results, room)
+				break
+			}
+		}
+	}
+	// map iteration order is random, keep the output stable
+	sort.Slice(results, func(i, j int) bool { return results[i].CreatedAt < results[j].CreatedAt })
+	return results, nil
+}
+
+// ListPublicChatrooms: the cursor is the offset of the next room in the sorted directory.
+func (s *MemoryStore) ListPublicChatrooms(q DirectoryQuery) (DirectoryPage, error) {
+	s.mu.RLock()
+	var rooms []models.Chatroom
+	for _, room := range s.chatrooms {
+		name := strings.ToLower(room.Name)
+		if room.IsPrivate || room.IsDM() || !strings.HasPrefix(name, q.Prefix) || !strings.Contains(name, q.Search) {
+			continue
+		}
+		rooms = append(rooms, roomItem(room))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool {
+		a, b := rooms[i], rooms[j]
+		switch {
+		case q.Sort == SortMembers && a.MemberCount != b.MemberCount:
+			return a.MemberCount > b.MemberCount
+		case q.Sort == SortName && strings.ToLower(a.Name) != strings.ToLower(b.Name):
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		case q.Sort != SortName && a.CreatedAt != b.CreatedAt:
+			return a.CreatedAt > b.CreatedAt
+		}
+		return a.RoomID < b.RoomID
+	})
+
+	var page DirectoryPage
+	offset := 0
+	if q.Cursor != "" {
+		n, err := strconv.Atoi(q.Cursor)
+		if err != nil || n < 0 {
+			return page, ErrInvalidCursor
+		}
+		offset = min(n, len(rooms))
+	}
+	end := min(offset+q.Limit, len(rooms))
+	page.Chatrooms = rooms[offset:end]
+	if end < len(rooms) {
+		page.NextCursor = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) SaveMessage(msg models.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.ThreadRootID != "" {
+		i, ok := s.findMessage(msg.RoomID, msg.ThreadRootID)
+		if !ok {
+			return ErrMessageNotFound
+		}
+		root := &s.messages[msg.RoomID][i]
+		root.ReplyCount++
+		root.LastReplyAt = msg.Timestamp
+	}
+	msgs := s.messages[msg.RoomID]
+	// keep the room sorted by message_id
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].MessageID >= msg.MessageID })
+	msgs = append(msgs, models.Message{})
+	copy(msgs[i+1:], msgs[i:])
+	msgs[i] = msg
+	s.messages[msg.RoomID] = msgs
+	return nil
+}
+
+func (s *MemoryStore) findMessage(roomID, messageID string) (int, bool) {
+	msgs := s.messages[roomID]
+	i := sort.Search(len(msgs), func(i int) bool { return msgs[i].MessageID >= messageID })
+	return i, i < len(msgs) && msgs[i].MessageID == messageID
+}
+
+func (s *MemoryStore) GetMessage(roomID, messageID string) (models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.findMessage(roomID, messageID)
+	if !ok {
+		return models.Message{}, ErrMessageNotFound
+	}
+	return s.messages[roomID][i], nil
+}
+
+// changeMessage applies change to the stored message if it still matches msg.
+func (s *MemoryStore) changeMessage(msg models.Message, rev models.MessageRevision, change func(*models.Message)) (models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.findMessage(msg.RoomID, msg.MessageID)
+	if !ok {
+		return models.Message{}, ErrMessageNotFound
+	}
+	current := &s.messages[msg.RoomID][i]
+	if current.Deleted || current.Text != msg.Text {
+		return models.Message{}, ErrConflict
+	}
+	change(current)
+	s.revisions[msg.RoomID] = append(s.revisions[msg.RoomID], rev)
+	return *current, nil
+}
+
+func (s *MemoryStore) EditMessage(msg models.Message, text, editor string) (models.Message, error) {
+	now := time.Now()
+	return s.changeMessage(msg, models.NewMessageRevision(msg, "edit", editor, now), func(m *models.Message) {
+		m.Text = text
+		m.EditedAt = now.Format(time.RFC3339)
+	})
+}
+
+func (s *MemoryStore) DeleteMessage(msg models.Message, by string) (models.Message, error) {
+	now := time.Now()
+	return s.changeMessage(msg, models.NewMessageRevision(msg, "delete", by, now), func(m *models.Message) {
+		m.Text = ""
+		m.Attachments = nil
+		m.Deleted = true
+		m.DeletedAt = now.Format(time.RFC3339)
+		m.DeletedBy = by
+	})
+}
+
+func (s *MemoryStore) ListMessageRevisions(roomID, messageID string) ([]models.MessageRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var revs []models.MessageRevision
+	for _, rev := range s.revisions[roomID] {
+		if rev.MessageID == messageID {
+			revs = append(revs, rev)
+		}
+	}
+	return revs, nil
+}
+
+func (s *MemoryStore) AddReaction(r models.Reaction) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.findMessage(r.RoomID, r.MessageID); !ok {
+		return false, ErrMessageNotFound
+	}
+	room := s.reactions[r.RoomID]
+	if room == nil {
+		room = make(map[string]models.Reaction)
+		s.reactions[r.RoomID] = room
+	}
+	if _, ok := room[r.ReactionKey]; ok {
+		return false, nil
+	}
+	room[r.ReactionKey] = r
+	return true, nil
+}
+
+func (s *MemoryStore) RemoveReaction(roomID, messageID, emoji, username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := models.ReactionKey(messageID, emoji, username)
+	if _, ok := s.reactions[roomID][key]; !ok {
+		return false, nil
+	}
+	delete(s.reactions[roomID], key)
+	return true, nil
+}
+
+func (s *MemoryStore) ListReactions(roomID string, messageIDs []string) ([]models.Reaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wanted := make(map[string]bool, len(messageIDs))
+	for _, id := range messageIDs {
+		wanted[id] = true
+	}
+	var out []models.Reaction
+	for _, r := range s.reactions[roomID] {
+		if wanted[r.MessageID] {
+			out = append(out, r)
+		}
+	}
+	// same order as the DynamoDB queries: by message, then emoji, then user
+	sort.Slice(out, func(i, j int) bool { return out[i].ReactionKey < out[j].ReactionKey })
+	return out, nil
+}
+
+func (s *MemoryStore) QueryMessages(q MessageQuery) (MessagePage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msgs := s.messages[q.RoomID]
+	var page MessagePage
+
+	inRange := func(id string) bool {
+		switch {
+		case q.Cursor == "":
+			return true
+		case q.Forward && q.Inclusive:
+			return id >= q.Cursor
+		case q.Forward:
+			return id > q.Cursor
+		case q.Inclusive:
+			return id <= q.Cursor
+		default:
+			return id < q.Cursor
+		}
+	}
+
+	// same paging contract as a DynamoDB Query with Limit: LastKey is set when the limit was hit
+	step, i := -1, len(msgs)-1
+	if q.Forward {
+		step, i = 1, 0
+	}
+	for ; i >= 0 && i < len(msgs); i += step {
+		if !inRange(msgs[i].MessageID) || msgs[i].ThreadRootID != q.ThreadRootID {
+			continue
+		}
+		page.Messages = append(page.Messages, msgs[i])
+		if len(page.Messages) == q.Limit {
+			page.LastKey = msgs[i].MessageID
+			break
+		}
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) CountUnread(roomID, afterID, username string, limit int) (int, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msgs := s.messages[roomID]
+	n := 0
+	for i := len(msgs) - 1; i >= 0 && msgs[i].MessageID > afterID; i-- {
+		if msgs[i].ThreadRootID == "" && msgs[i].Sender != username {
+			if n == limit {
+				return n, true, nil
+			}
+			n++
+		}
+	}
+	return n, false, nil
+}
+
+func (s *MemoryStore) CreateInvite(invite models.Invite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invites[invite.Code] = invite
+	return nil
+}
+
+func (s *MemoryStore) GetInvite(code string) (models.Invite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	invite, ok := s.invites[code]
+	if !ok {
+		return models.Invite{}, ErrInviteNotFound
+	}
+	return invite, nil
+}
+
+func (s *MemoryStore) ListInvites(roomID string) ([]models.Invite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []models.Invite
+	for _, invite := range s.invites {
+		if invite.RoomID == roomID {
+			results = append(results, invite)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].CreatedAt < results[j].CreatedAt })
+	return results, nil
+}
+
+func (s *MemoryStore) RevokeInvite(roomID, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[code]
+	if !ok || invite.RoomID != roomID {
+		return ErrInviteNotFound
+	}
+	invite.Revoked = true
+	s.invites[code] = invite
+	return nil
+}
+
+func (s *MemoryStore) UseInvite(code string, now int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[code]
+	if !ok {
+		return ErrInviteNotFound
+	}
+	if invite.Revoked || (invite.ExpiresAt != 0 && invite.ExpiresAt <= now) ||
+		(invite.MaxUses != 0 && invite.Uses >= invite.MaxUses) {
+		return ErrInviteInvalid
+	}
+	invite.Uses++
+	s.invites[code] = invite
+	return nil
+}
+
+func (s *MemoryStore) ReleaseInvite(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invite, ok := s.invites[code]
+	if !ok || invite.Uses == 0 {
+		return nil
+	}
+	invite.Uses--
+	s.invites[code] = invite
+	return nil
+}
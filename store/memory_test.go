@@ -0,0 +1,177 @@
+package store
+
+import (
+	"chatroom-api/models"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	s := NewMemoryStore()
+	if err := s.CreateUser(models.User{Username: "alice", Password: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateUser(models.User{Username: "alice", Password: "b"}); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("duplicate user: err = %v, want ErrUserExists", err)
+	}
+	if _, err := s.GetUserByUsername("bob"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("missing user: err = %v, want ErrUserNotFound", err)
+	}
+	if err := s.UpdateUserPassword("alice", "c"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.GetUserByUsername("alice")
+	if err != nil || u.Password != "c" {
+		t.Fatalf("user = %+v, %v, want password c", u, err)
+	}
+}
+
+func TestMemoryChatroomMembers(t *testing.T) {
+	s := NewMemoryStore()
+	room := models.Chatroom{RoomID: "r1", Name: "general", Users: []string{"alice"}}
+	if err := s.CreateChatroom(room); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateChatroom(room); !errors.Is(err, ErrChatroomExists) {
+		t.Fatalf("duplicate room: err = %v, want ErrChatroomExists", err)
+	}
+	if err := s.AddUserToChatroom("bob", "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUserToChatroom("bob", "r1"); err != nil {
+		t.Fatalf("adding a member twice: %v", err)
+	}
+	got, err := s.GetChatroom("r1")
+	if err != nil || got.MemberCount != 2 || got.Users != nil {
+		t.Fatalf("room = %+v, %v, want 2 members and none loaded", got, err)
+	}
+	if _, err := s.GetMember("r1", "mallory"); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("GetMember of a stranger: err = %v, want ErrNotMember", err)
+	}
+	_ = s.SetMemberRole("r1", "alice", "owner")
+	if m, err := s.GetMember("r1", "alice"); err != nil || m.Role != "owner" {
+		t.Fatalf("member alice = %+v, %v, want owner", m, err)
+	}
+	if members, _ := s.ListMembers("r1"); len(members) != 2 {
+		t.Fatalf("members = %+v, want alice and bob", members)
+	}
+
+	rooms, _ := s.GetChatroomsByUsername("bob")
+	if len(rooms) != 1 || rooms[0].RoomID != "r1" {
+		t.Fatalf("rooms of bob = %+v", rooms)
+	}
+	if err := s.RemoveUserFromChatroom("bob", "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if rooms, _ := s.GetChatroomsByUsername("bob"); len(rooms) != 0 {
+		t.Fatalf("bob still has rooms after leaving: %+v", rooms)
+	}
+	if err := s.AddUserToChatroom("bob", "missing"); !errors.Is(err, ErrChatroomNotFound) {
+		t.Fatalf("join missing room: err = %v, want ErrChatroomNotFound", err)
+	}
+}
+
+func TestMemoryQueryMessages(t *testing.T) {
+	s := NewMemoryStore()
+	ids := []string{"01A", "01B", "01C", "01D"}
+	for _, id := range ids {
+		if err := s.SaveMessage(models.Message{RoomID: "r1", MessageID: id, Sender: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := s.QueryMessages(MessageQuery{RoomID: "r1", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messageIDs(page.Messages); got != "01D,01C" || page.LastKey != "01C" {
+		t.Fatalf("newest page = %s (last %q), want 01D,01C (last 01C)", got, page.LastKey)
+	}
+	page, _ = s.QueryMessages(MessageQuery{RoomID: "r1", Cursor: page.LastKey, Limit: 2})
+	if got := messageIDs(page.Messages); got != "01B,01A" {
+		t.Fatalf("older page = %s, want 01B,01A", got)
+	}
+	page, _ = s.QueryMessages(MessageQuery{RoomID: "r1", Cursor: "01B", Forward: true, Inclusive: true, Limit: 10})
+	if got := messageIDs(page.Messages); got != "01B,01C,01D" || page.LastKey != "" {
+		t.Fatalf("forward page = %s (last %q), want 01B,01C,01D", got, page.LastKey)
+	}
+}
+
+func TestMemoryCountUnread(t *testing.T) {
+	s := NewMemoryStore()
+	for i, sender := range []string{"alice", "bob", "bob", "bob"} {
+		if err := s.SaveMessage(models.Message{RoomID: "r1", MessageID: fmt.Sprintf("01%c", 'A'+i), Sender: sender}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, capped, _ := s.CountUnread("r1", "", "alice", 10); n != 3 || capped {
+		t.Fatalf("unread = %d (capped %v), want 3", n, capped)
+	}
+	if n, capped, _ := s.CountUnread("r1", "01B", "alice", 10); n != 2 || capped {
+		t.Fatalf("unread after 01B = %d (capped %v), want 2", n, capped)
+	}
+	if n, capped, _ := s.CountUnread("r1", "", "alice", 3); n != 3 || capped {
+		t.Fatalf("unread at the limit = %d (capped %v), want exactly 3", n, capped)
+	}
+	if n, capped, _ := s.CountUnread("r1", "", "alice", 2); n != 2 || !capped {
+		t.Fatalf("unread over the limit = %d (capped %v), want 2+", n, capped)
+	}
+}
+
+func messageIDs(msgs []models.Message) string {
+	out := ""
+	for i, m := range msgs {
+		if i > 0 {
+			out += ","
+		}
+		out += m.MessageID
+	}
+	return out
+}
+
+func TestMemoryInviteUses(t *testing.T) {
+	s := NewMemoryStore()
+	const now = 1000
+	_ = s.CreateInvite(models.Invite{Code: "two", RoomID: "r1", MaxUses: 2})
+	_ = s.CreateInvite(models.Invite{Code: "expired", RoomID: "r1", ExpiresAt: now})
+	_ = s.CreateInvite(models.Invite{Code: "revoked", RoomID: "r1"})
+	_ = s.CreateInvite(models.Invite{Code: "unlimited", RoomID: "r1"})
+	_ = s.RevokeInvite("r1", "revoked")
+
+	for i := 0; i < 2; i++ {
+		if err := s.UseInvite("two", now); err != nil {
+			t.Fatalf("use %d: %v", i+1, err)
+		}
+	}
+	if err := s.UseInvite("two", now); !errors.Is(err, ErrInviteInvalid) {
+		t.Fatalf("third use: err = %v, want ErrInviteInvalid", err)
+	}
+	if err := s.ReleaseInvite("two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UseInvite("two", now); err != nil {
+		t.Fatalf("use after release: %v", err)
+	}
+
+	if err := s.UseInvite("expired", now); !errors.Is(err, ErrInviteInvalid) {
+		t.Fatalf("expired: err = %v, want ErrInviteInvalid", err)
+	}
+	if err := s.UseInvite("revoked", now); !errors.Is(err, ErrInviteInvalid) {
+		t.Fatalf("revoked: err = %v, want ErrInviteInvalid", err)
+	}
+	if err := s.UseInvite("missing", now); !errors.Is(err, ErrInviteNotFound) {
+		t.Fatalf("missing: err = %v, want ErrInviteNotFound", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := s.UseInvite("unlimited", now); err != nil {
+			t.Fatalf("unlimited use %d: %v", i+1, err)
+		}
+	}
+	if err := s.ReleaseInvite("expired"); err != nil {
+		t.Fatal(err)
+	}
+	if inv, _ := s.GetInvite("expired"); inv.Uses != 0 {
+		t.Fatalf("release went below zero: uses = %d", inv.Uses)
+	}
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"chatroom-api/models"
+	"errors"
+)
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrUserExists       = errors.New("username already exists")
+	ErrChatroomNotFound = errors.New("chatroom does not exist")
+	ErrChatroomExists   = errors.New("chatroom already exists")
+	ErrNotMember        = errors.New("user is not a member of the chatroom")
+	ErrConflict         = errors.New("modified concurrently")
+	ErrMessageNotFound  = errors.New("message does not exist")
+	ErrInvalidCursor    = errors.New("invalid cursor")
+	ErrInviteNotFound   = errors.New("invite does not exist")
+	ErrInviteInvalid    = errors.New("invite is expired, revoked or used up")
+)
+
+type UserStore interface {
+	CreateUser(user models.User) error
+	GetUserByUsername(username string) (*models.User, error)
+	UpdateUserPassword(username, password string) error
+}
+
+type ChatroomStore interface {
+	// CreateChatroom fails with ErrChatroomExists if the room id is taken, ErrConflict if a
+	// concurrent write got in the way (the room may exist then).
+	CreateChatroom(chatroom models.Chatroom) error
+	// GetChatroom reads the room item, Users, Roles and LastRead are left empty.
+	// See ChatroomWith and ChatroomWithMembers.
+	GetChatroom(roomID string) (models.Chatroom, error)
+	// GetMember reads one membership, ErrNotMember if username is not in the room.
+	GetMember(roomID, username string) (models.Member, error)
+	ListMembers(roomID string) ([]models.Member, error)
+	// UpdateChatroom applies update to the latest version of the room and writes it back if
+	// nobody changed the room in between, retrying otherwise. update may run several times,
+	// ErrConflict is returned when the retries are exhausted.
+	UpdateChatroom(roomID string, update func(*models.Chatroom) error) (models.Chatroom, error)
+	// DeleteChatroom removes the room with its memberships, messages and invites.
+	DeleteChatroom(roomID string) error
+	AddUserToChatroom(username, roomID string) error
+	RemoveUserFromChatroom(username, roomID string) error
+	GetChatroomsByUsername(username string) ([]models.Chatroom, error)
+	// SetMemberRole stores a member's role, "member" clears it.
+	SetMemberRole(roomID, username, role string) error
+	// ListPublicChatrooms reads one page of the public room directory.
+	ListPublicChatrooms(q DirectoryQuery) (DirectoryPage, error)
+	// MarkRead moves the read position of username forward to messageID, never back.
+	// ErrNotMember if the user is not a member.
+	MarkRead(roomID, username, messageID string) error
+	// TransferOwnership makes to the owner and demotes from to admin in one write.
+	// ErrConflict is returned if from is no longer the owner.
+	TransferOwnership(roomID, from, to string) error
+}
+
+// Directory sort orders.
+const (
+	SortCreated = "created" // newest first
+	SortMembers = "members" // most members first
+	SortName    = "name"    // A-Z
+)
+
+// DirectoryQuery selects one page of public rooms. Prefix and Search match the
+// lower-cased room name.
+type DirectoryQuery struct {
+	Prefix string
+	Search string // substring
+	Sort   string
+	Limit  int
+	Cursor string // NextCursor of the previous page
+}
+
+type DirectoryPage struct {
+	Chatrooms  []models.Chatroom
+	NextCursor string // "" on the last page
+}
+
+// MessageQuery selects one page of a room's history, ordered by message_id.
+type MessageQuery struct {
+	RoomID    string
+	Cursor    string // message_id to start from, "" = from the newest (or oldest if Forward) end
+	Forward   bool   // false: message_id < Cursor, newest first; true: message_id > Cursor, oldest first
+	Inclusive bool   // also return the Cursor message itself
+	Limit     int
+	// ThreadRootID selects the replies of a thread, "" the room timeline (top-level messages only)
+	ThreadRootID string
+}
+
+type MessagePage struct {
+	Messages []models.Message
+	LastKey  string // message_id of the last evaluated item, "" when the range is exhausted
+}
+
+type MessageStore interface {
+	// SaveMessage stores a message. For a reply it also updates reply_count and last_reply_at
+	// of the thread root, ErrMessageNotFound if the root does not exist.
+	SaveMessage(msg models.Message) error
+	GetMessage(roomID, messageID string) (models.Message, error)
+	// EditMessage replaces the text of msg (as read by the caller) and keeps the old text
+	// as a revision. ErrConflict if the message changed or was deleted in the meantime.
+	EditMessage(msg models.Message, text, editor string) (models.Message, error)
+	// DeleteMessage turns msg into a tombstone, keeping its text as a revision.
+	// Attachments are dropped, their blobs are deleted by the caller.
+	DeleteMessage(msg models.Message, by string) (models.Message, error)
+	ListMessageRevisions(roomID, messageID string) ([]models.MessageRevision, error)
+	QueryMessages(q MessageQuery) (MessagePage, error)
+	// CountUnread counts the timeline messages after afterID ("" = all) not sent by
+	// username, stopping at limit. capped reports that counting stopped early and there
+	// may be more than n, shown as "n+".
+	CountUnread(roomID, afterID, username string, limit int) (n int, capped bool, err error)
+}
+
+type ReactionStore interface {
+	// AddReaction is idempotent, added is false if the user already reacted with the emoji.
+	// ErrMessageNotFound if the message does not exist.
+	AddReaction(r models.Reaction) (added bool, err error)
+	// RemoveReaction is idempotent, removed is false if there was no such reaction.
+	RemoveReaction(roomID, messageID, emoji, username string) (removed bool, err error)
+	// ListReactions returns the reactions of the given messages.
+	ListReactions(roomID string, messageIDs []string) ([]models.Reaction, error)
+}
+
+type InviteStore interface {
+	CreateInvite(invite models.Invite) error
+	GetInvite(code string) (models.Invite, error)
+	ListInvites(roomID string) ([]models.Invite, error)
+	RevokeInvite(roomID, code string) error
+	// UseInvite atomically counts one use, failing with ErrInviteInvalid if the invite
+	// is revoked, expired (now is unix seconds) or has no uses left.
+	UseInvite(code string, now int64) error
+	// ReleaseInvite gives back a use counted by UseInvite when the join failed afterwards.
+	ReleaseInvite(code string) error
+}
+
+// Store is a complete storage backend (DynamoDB, in-memory, ...).
+type Store interface {
+	UserStore
+	ChatroomStore
+	MessageStore
+	ReactionStore
+	InviteStore
+}
+
+// Backends selected at startup, used by the handlers.
+var (
+	Users     UserStore
+	Chatrooms ChatroomStore
+	Messages  MessageStore
+	Reactions ReactionStore
+	Invites   InviteStore
+)
+
+func Init(s Store) {
+	Users = s
+	Chatrooms = s
+	Messages = s
+	Reactions = s
+	Invites = s
+}
+
+// ChatroomWith loads the room and the memberships of usernames, one item read each.
+// Users, Roles and LastRead only cover those of usernames who are members, which is
+// enough to authorize them against each other.
+func ChatroomWith(roomID string, usernames ...string) (models.Chatroom, error) {
+	chatroom, err := Chatrooms.GetChatroom(roomID)
+	if err != nil {
+		return chatroom, err
+	}
+	for _, u := range usernames {
+		m, err := Chatrooms.GetMember(roomID, u)
+		if errors.Is(err, ErrNotMember) {
+			continue
+		}
+		if err != nil {
+			return chatroom, err
+		}
+		chatroom.AddMember(m)
+	}
+	return chatroom, nil
+}
+
+// ChatroomWithMembers loads the room with all its members, for the endpoints that list them.
+func ChatroomWithMembers(roomID string) (models.Chatroom, error) {
+	chatroom, err := Chatrooms.GetChatroom(roomID)
+	if err != nil {
+		return chatroom, err
+	}
+	members, err := Chatrooms.ListMembers(roomID)
+	if err != nil {
+		return chatroom, err
+	}
+	for _, m := range members {
+		chatroom.AddMember(m)
+	}
+	return chatroom, nil
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+)
+
+// FILE_URL_SECRET signs attachment download links. It is kept apart from JWT_SECRET and is
+// required: without it nothing is signed and no link verifies, see CheckFileURLSecret.
+// Read on each call so values loaded from .env after package init are honored.
+func fileURLSecret() []byte {
+	return []byte(os.Getenv("FILE_URL_SECRET"))
+}
+
+var ErrFileURLSecretMissing = errors.New("FILE_URL_SECRET is not set")
+
+// CheckFileURLSecret is called at startup, download links cannot work without the secret.
+func CheckFileURLSecret() error {
+	if len(fileURLSecret()) == 0 {
+		return ErrFileURLSecretMissing
+	}
+	return nil
+}
+
+// SignFileURL returns the signature of a download link of roomID/attachmentID for username,
+// valid until expires (unix seconds). Without a secret the signature is empty.
+func SignFileURL(roomID, attachmentID, name, username string, expires int64) string {
+	secret := fileURLSecret()
+	if len(secret) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range []string{roomID, attachmentID, name, username, strconv.FormatInt(expires, 10)} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifyFileURL(roomID, attachmentID, name, username string, expires int64, sig string) bool {
+	expected := SignFileURL(roomID, attachmentID, name, username, expires)
+	return expected != "" && hmac.Equal([]byte(expected), []byte(sig))
+}
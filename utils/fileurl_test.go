@@ -0,0 +1,43 @@
+package utils
+
+import "testing"
+
+func TestVerifyFileURL(t *testing.T) {
+	t.Setenv("FILE_URL_SECRET", "file-secret")
+	sig := SignFileURL("room", "att", "a.png", "alice", 1700000000)
+	if !VerifyFileURL("room", "att", "a.png", "alice", 1700000000, sig) {
+		t.Fatal("signature of the same link does not verify")
+	}
+	// every part is signed, and the parts cannot be shifted into each other
+	for _, c := range []struct{ room, att, name, user string }{
+		{"other", "att", "a.png", "alice"},
+		{"room", "other", "a.png", "alice"},
+		{"room", "att", "b.png", "alice"},
+		{"room", "att", "a.png", "bob"},
+		{"roomatt", "", "a.png", "alice"},
+	} {
+		if VerifyFileURL(c.room, c.att, c.name, c.user, 1700000000, sig) {
+			t.Errorf("signature verifies for %v", c)
+		}
+	}
+	if VerifyFileURL("room", "att", "a.png", "alice", 1700000001, sig) {
+		t.Error("signature verifies for another expiry")
+	}
+	t.Setenv("FILE_URL_SECRET", "rotated")
+	if VerifyFileURL("room", "att", "a.png", "alice", 1700000000, sig) {
+		t.Error("signature verifies with another secret")
+	}
+}
+
+func TestFileURLWithoutSecret(t *testing.T) {
+	t.Setenv("FILE_URL_SECRET", "")
+	t.Setenv("JWT_SECRET", "jwt-secret")
+	if err := CheckFileURLSecret(); err == nil {
+		t.Fatal("startup check passes without FILE_URL_SECRET")
+	}
+	// the JWT key is not used, and an empty key signs nothing
+	sig := SignFileURL("room", "att", "a.png", "alice", 1700000000)
+	if sig != "" || VerifyFileURL("room", "att", "a.png", "alice", 1700000000, sig) {
+		t.Fatalf("link signed without FILE_URL_SECRET: %q", sig)
+	}
+}
@@ -10,12 +10,16 @@ import (
 
 var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
 
-// Create Token (pass in the username).
-func GenerateToken(username string) (string, error) {
+// Access tokens are short-lived, clients renew them with a refresh token.
+const AccessTokenTTL = 15 * time.Minute
+
+// Create Token (pass in the username and the session it belongs to).
+func GenerateToken(username, sessionID string) (string, error) {
 	log.Log.Infof("Generate Token request: username=%s", username)
 	claims := jwt.MapClaims{
 		"username": username,
-		"exp":      time.Now().Add(24 * time.Hour).Unix(), // Token expiration time: 24 hours.
+		"sid":      sessionID,
+		"exp":      time.Now().Add(AccessTokenTTL).Unix(), // Token expiration time: 15 minutes.
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -23,8 +27,8 @@ func GenerateToken(username string) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
-// parse Token, return username
-func ParseToken(tokenString string) (string, error) {
+// parse Token, return username and session id
+func ParseToken(tokenString string) (string, string, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Verify the signature
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -36,18 +40,19 @@ func ParseToken(tokenString string) (string, error) {
 
 	if err != nil || !token.Valid {
 		log.Log.Warnf("invalid token: %v", err)
-		return "", errors.New("invalid token")
+		return "", "", errors.New("invalid token")
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok {
 		username, ok := claims["username"].(string)
 		if !ok {
 			log.Log.Warn("username not found in token")
-			return "", errors.New("username not found in token")
+			return "", "", errors.New("username not found in token")
 		}
+		sessionID, _ := claims["sid"].(string)
 		log.Log.Infof("Token successfully parsed: username=%s", username)
-		return username, nil
+		return username, sessionID, nil
 	}
 
-	return "", errors.New("failed to parse token claims")
+	return "", "", errors.New("failed to parse token claims")
 }
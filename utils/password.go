@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// HashPassword returns a salted bcrypt hash of the password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsPasswordHashed reports whether a stored password is already a bcrypt hash.
+// Rows written before hashing was introduced still hold the plaintext.
+func IsPasswordHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword compares a password with the stored value in constant time.
+// Legacy plaintext values are still accepted, the caller is expected to re-hash them.
+func CheckPassword(stored, password string) bool {
+	if IsPasswordHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
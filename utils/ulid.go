@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// ULID: 48-bit millisecond timestamp + 80-bit randomness, Crockford base32 encoded (26 chars).
+// IDs sort lexicographically by time, so they can be used directly as a DynamoDB sort key.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	ulidMu       sync.Mutex
+	ulidLastMs   uint64
+	ulidLastRand [10]byte
+)
+
+// NewULID returns a new ID. IDs generated in the same millisecond by this process are
+// monotonic (the random part is incremented) so they never collide and keep their order.
+func NewULID() string {
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= ulidLastMs {
+		ms = ulidLastMs
+		incrementEntropy(&ulidLastRand)
+	} else {
+		ulidLastMs = ms
+		_, _ = rand.Read(ulidLastRand[:])
+	}
+	return encodeULID(ms, ulidLastRand)
+}
+
+// ULIDWithEntropy builds an ID for a given time with caller supplied randomness (at least
+// 10 bytes). Used to derive stable IDs for rows written before message IDs existed.
+func ULIDWithEntropy(t time.Time, entropy []byte) string {
+	var r [10]byte
+	copy(r[:], entropy)
+	return encodeULID(uint64(t.UnixMilli()), r)
+}
+
+// ULIDLowerBound returns the smallest ID of the given time: every message created at or
+// after t has an ID >= this value.
+func ULIDLowerBound(t time.Time) string {
+	return encodeULID(uint64(t.UnixMilli()), [10]byte{})
+}
+
+// ULIDTime extracts the timestamp of an ID, ok is false if it is not a valid ULID.
+func ULIDTime(id string) (time.Time, bool) {
+	if len(id) != 26 {
+		return time.Time{}, false
+	}
+	var ms uint64
+	for i := 0; i < 10; i++ {
+		v := indexCrockford(id[i])
+		if v < 0 {
+			return time.Time{}, false
+		}
+		ms = ms<<5 | uint64(v)
+	}
+	return time.UnixMilli(int64(ms)), true
+}
+
+func indexCrockford(c byte) int {
+	for i := 0; i < len(crockford); i++ {
+		if crockford[i] == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func incrementEntropy(r *[10]byte) {
+	for i := len(r) - 1; i >= 0; i-- {
+		r[i]++
+		if r[i] != 0 {
+			return
+		}
+	}
+}
+
+func encodeULID(ms uint64, r [10]byte) string {
+	// 128 bits: 16 bytes = 6 bytes of time + 10 bytes of entropy
+	var b [16]byte
+	var tb [8]byte
+	binary.BigEndian.PutUint64(tb[:], ms)
+	copy(b[:6], tb[2:])
+	copy(b[6:], r[:])
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	// 26 chars * 5 bits = 130 bits, the first char only carries 3 bits
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewULIDMonotonic(t *testing.T) {
+	prev := NewULID()
+	for i := 0; i < 10000; i++ {
+		id := NewULID()
+		if len(id) != 26 {
+			t.Fatalf("len(%q) = %d, want 26", id, len(id))
+		}
+		if id <= prev {
+			t.Fatalf("ULID %q after %q is not increasing", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestULIDTime(t *testing.T) {
+	now := time.UnixMilli(time.Now().UnixMilli())
+	got, ok := ULIDTime(ULIDWithEntropy(now, make([]byte, 10)))
+	if !ok || !got.Equal(now) {
+		t.Fatalf("ULIDTime = %v, %v, want %v", got, ok, now)
+	}
+	if _, ok := ULIDTime("not-a-ulid"); ok {
+		t.Fatal("ULIDTime accepted an invalid id")
+	}
+	if _, ok := ULIDTime("01ARZ3NDUKTSV4RRFFQ69G5FAV"); ok {
+		t.Fatal("ULIDTime accepted a non-Crockford timestamp")
+	}
+}
+
+func TestULIDLowerBound(t *testing.T) {
+	at := time.Now()
+	bound := ULIDLowerBound(at)
+	if id := ULIDWithEntropy(at, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 1}); id <= bound {
+		t.Fatalf("%q is not above the lower bound %q of its millisecond", id, bound)
+	}
+	if earlier := ULIDWithEntropy(at.Add(-time.Millisecond), []byte("ffffffffff")); earlier >= bound {
+		t.Fatalf("%q of the previous millisecond is not below %q", earlier, bound)
+	}
+}
+
+func TestULIDWithEntropyIsStable(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	a := ULIDWithEntropy(at, []byte("0123456789abcdef"))
+	b := ULIDWithEntropy(at, []byte("0123456789abcdef"))
+	if a != b {
+		t.Fatalf("same input gave %q and %q", a, b)
+	}
+}
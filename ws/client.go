@@ -0,0 +1,165 @@
+package ws
+
+import (
+	log "chatroom-api/logger"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"time"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxMessageSize = 8 * 1024
+	sendBufferSize = 64
+)
+
+// TokenProtocol is offered by browser clients together with the access token as the next
+// subprotocol ("access_token, <jwt>"), the server selects it in the handshake.
+const TokenProtocol = "access_token"
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{TokenProtocol},
+	// CORS already allows every origin for the REST API
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type Client struct {
+	ID       string // unique per connection
+	RoomID   string
+	Username string
+	hub      *Hub
+	conn     *websocket.Conn
+	send     chan []byte
+	status   string // presence chosen by the client, only used from the read goroutine
+}
+
+// Handlers are called from the connection's read goroutine, all of them are optional.
+type Handlers struct {
+	OnOpen    func(c *Client)
+	OnMessage func(c *Client, data []byte) // every frame received from the client
+	OnPong    func(c *Client)              // the client answered a ping, about every pingPeriod
+	OnClose   func(c *Client)
+}
+
+func newClientID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Serve upgrades the request and blocks until the connection is closed.
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, roomID, username string, handlers Handlers) error {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	c := &Client{
+		ID:       newClientID(),
+		RoomID:   roomID,
+		Username: username,
+		hub:      h,
+		conn:     conn,
+		send:     make(chan []byte, sendBufferSize),
+	}
+	h.register(c)
+	go c.writePump()
+	if handlers.OnOpen != nil {
+		handlers.OnOpen(c)
+	}
+	c.readPump(handlers)
+	return nil
+}
+
+func (c *Client) readPump(handlers Handlers) {
+	defer func() {
+		c.hub.unregister(c)
+		_ = c.conn.Close()
+		if handlers.OnClose != nil {
+			handlers.OnClose(c)
+		}
+	}()
+	c.conn.SetReadLimit(maxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		if handlers.OnPong != nil {
+			handlers.OnPong(c)
+		}
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Log.Warnf("ws read error: user=%s, room=%s, err=%v", c.Username, c.RoomID, err)
+			}
+			return
+		}
+		if handlers.OnMessage != nil {
+			handlers.OnMessage(c, data)
+		}
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+	for {
+		select {
+		case payload, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// hub closed the channel
+				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Send pushes an event to this client only.
+func (c *Client) Send(event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Log.Errorf("marshal ws event failed: %v", err)
+		return
+	}
+	c.hub.mu.RLock()
+	defer c.hub.mu.RUnlock()
+	if !c.hub.rooms[c.RoomID][c] {
+		return // already unregistered, send is closed
+	}
+	select {
+	case c.send <- payload:
+	default:
+	}
+}
+
+func (c *Client) Status() string {
+	return c.status
+}
+
+func (c *Client) SetStatus(status string) {
+	c.status = status
+}
+
+func (c *Client) SendError(message string) {
+	c.Send(Event{Type: "error", RoomID: c.RoomID, Data: message})
+}
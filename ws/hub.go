@@ -0,0 +1,192 @@
+package ws
+
+import (
+	"bytes"
+	"chatroom-api/bus"
+	log "chatroom-api/logger"
+	"encoding/json"
+	"sync"
+)
+
+// Event is the envelope of everything pushed to clients.
+type Event struct {
+	Type   string      `json:"type"`
+	RoomID string      `json:"room_id"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Hub keeps the WebSocket clients connected to this instance, grouped by room.
+// Events go through the bus so that clients connected to other instances get them too.
+type Hub struct {
+	bus   bus.Bus
+	subMu sync.Mutex // serializes room subscribe/unsubscribe
+	mu    sync.RWMutex
+	rooms map[string]map[*Client]bool
+}
+
+// DefaultHub is replaced in main when running with several replicas.
+var DefaultHub = NewHub(bus.NewLocal())
+
+func NewHub(b bus.Bus) *Hub {
+	return &Hub{bus: b, rooms: make(map[string]map[*Client]bool)}
+}
+
+func (h *Hub) register(c *Client) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+
+	h.mu.Lock()
+	clients, ok := h.rooms[c.RoomID]
+	if !ok {
+		clients = make(map[*Client]bool)
+		h.rooms[c.RoomID] = clients
+	}
+	clients[c] = true
+	online := len(clients)
+	h.mu.Unlock()
+	log.Log.Infof("ws client registered: user=%s, room=%s, online=%d", c.Username, c.RoomID, online)
+
+	// first local client of the room: start receiving its events
+	if online == 1 {
+		roomID := c.RoomID
+		if err := h.bus.Subscribe(roomID, func(payload []byte) { h.deliver(roomID, payload) }); err != nil {
+			log.Log.Errorf("subscribe room failed: room=%s, err=%v", roomID, err)
+		}
+	}
+}
+
+func (h *Hub) unregister(c *Client) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+
+	h.mu.Lock()
+	clients, ok := h.rooms[c.RoomID]
+	if !ok || !clients[c] {
+		h.mu.Unlock()
+		return
+	}
+	delete(clients, c)
+	close(c.send)
+	empty := len(clients) == 0
+	if empty {
+		delete(h.rooms, c.RoomID)
+	}
+	h.mu.Unlock()
+	log.Log.Infof("ws client unregistered: user=%s, room=%s", c.Username, c.RoomID)
+
+	if empty {
+		if err := h.bus.Unsubscribe(c.RoomID); err != nil {
+			log.Log.Errorf("unsubscribe room failed: room=%s, err=%v", c.RoomID, err)
+		}
+	}
+}
+
+// EventMemberRemoved tells the room a member left or was kicked. Clients of that member
+// are disconnected on every instance once the event has been delivered to them.
+const EventMemberRemoved = "member_removed"
+
+// EventRoomDeleted disconnects every client of the room after delivery.
+const EventRoomDeleted = "room_deleted"
+
+type MemberEvent struct {
+	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+	By       string `json:"by,omitempty"`
+}
+
+// Frames on the bus start with a header byte telling deliver what to do after passing the
+// event on, so payloads are never decoded again on the receiving instances:
+//
+//	'e' <event JSON>                       deliver
+//	'u' <username> 0x00 <event JSON>       deliver, then disconnect the user's clients
+//	'r' <event JSON>                       deliver, then disconnect every client of the room
+const (
+	frameEvent      byte = 'e'
+	frameDisconnect byte = 'u'
+	frameCloseRoom  byte = 'r'
+)
+
+// Broadcast sends an event to every client of the room, on every instance.
+func (h *Hub) Broadcast(event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Log.Errorf("marshal ws event failed: %v", err)
+		return
+	}
+	frame := []byte{frameEvent}
+	switch event.Type {
+	case EventMemberRemoved:
+		if m, ok := event.Data.(MemberEvent); ok {
+			frame = append([]byte{frameDisconnect}, m.Username...)
+			frame = append(frame, 0)
+		}
+	case EventRoomDeleted:
+		frame = []byte{frameCloseRoom}
+	}
+	frame = append(frame, payload...)
+	if err := h.bus.Publish(event.RoomID, frame); err != nil {
+		// keep the room working on this instance at least
+		log.Log.Errorf("publish ws event failed, delivering locally only: room=%s, err=%v", event.RoomID, err)
+		h.deliver(event.RoomID, frame)
+	}
+}
+
+func (h *Hub) deliver(roomID string, frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+	kind, payload, username := frame[0], frame[1:], ""
+	switch kind {
+	case frameEvent, frameCloseRoom:
+	case frameDisconnect:
+		i := bytes.IndexByte(payload, 0)
+		if i <= 0 {
+			log.Log.Warnf("invalid ws frame dropped: room=%s", roomID)
+			return
+		}
+		username, payload = string(payload[:i]), payload[i+1:]
+	default:
+		log.Log.Warnf("unknown ws frame %q dropped: room=%s", kind, roomID)
+		return
+	}
+
+	h.mu.RLock()
+	var slow []*Client
+	for c := range h.rooms[roomID] {
+		select {
+		case c.send <- payload:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	// a client that can not keep up is disconnected instead of blocking the room
+	for _, c := range slow {
+		log.Log.Warnf("ws client too slow, disconnecting: user=%s, room=%s", c.Username, c.RoomID)
+		h.unregister(c)
+	}
+
+	switch kind {
+	case frameDisconnect:
+		h.disconnect(roomID, username)
+	case frameCloseRoom:
+		h.disconnect(roomID, "")
+	}
+}
+
+// disconnect closes the local clients of username in the room, "" closes all of them.
+func (h *Hub) disconnect(roomID, username string) {
+	h.mu.RLock()
+	var clients []*Client
+	for c := range h.rooms[roomID] {
+		if username == "" || c.Username == username {
+			clients = append(clients, c)
+		}
+	}
+	h.mu.RUnlock()
+	for _, c := range clients {
+		log.Log.Infof("ws client removed from room: user=%s, room=%s", c.Username, c.RoomID)
+		h.unregister(c)
+	}
+}
@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"chatroom-api/bus"
+	"encoding/json"
+	"testing"
+)
+
+func testClient(h *Hub, roomID, username string) *Client {
+	c := &Client{ID: newClientID(), RoomID: roomID, Username: username, hub: h, send: make(chan []byte, sendBufferSize)}
+	h.register(c)
+	return c
+}
+
+// received returns the events queued for c and whether its connection was closed.
+func received(t *testing.T, c *Client) ([]Event, bool) {
+	t.Helper()
+	var events []Event
+	for {
+		select {
+		case payload, ok := <-c.send:
+			if !ok {
+				return events, true
+			}
+			var e Event
+			if err := json.Unmarshal(payload, &e); err != nil {
+				t.Fatalf("client got a frame that is not an event: %q", payload)
+			}
+			events = append(events, e)
+		default:
+			return events, false
+		}
+	}
+}
+
+func TestHubBroadcast(t *testing.T) {
+	h := NewHub(bus.NewLocal())
+	alice := testClient(h, "r1", "alice")
+	other := testClient(h, "r2", "bob")
+
+	h.Broadcast(Event{Type: "message", RoomID: "r1", Data: map[string]string{"text": "hi"}})
+	if events, closed := received(t, alice); len(events) != 1 || events[0].Type != "message" || closed {
+		t.Fatalf("alice got %v (closed %v)", events, closed)
+	}
+	if events, _ := received(t, other); len(events) != 0 {
+		t.Fatalf("another room got %v", events)
+	}
+}
+
+func TestHubMemberRemoved(t *testing.T) {
+	h := NewHub(bus.NewLocal())
+	alice := testClient(h, "r1", "alice")
+	bob := testClient(h, "r1", "bob")
+
+	h.Broadcast(Event{Type: EventMemberRemoved, RoomID: "r1", Data: MemberEvent{Username: "bob", By: "alice"}})
+	events, closed := received(t, bob)
+	if len(events) != 1 || events[0].Type != EventMemberRemoved || !closed {
+		t.Fatalf("bob got %v (closed %v), want the event and a disconnect", events, closed)
+	}
+	if events, closed := received(t, alice); len(events) != 1 || closed {
+		t.Fatalf("alice got %v (closed %v), want the event only", events, closed)
+	}
+
+	h.Broadcast(Event{Type: EventRoomDeleted, RoomID: "r1"})
+	if events, closed := received(t, alice); len(events) != 1 || events[0].Type != EventRoomDeleted || !closed {
+		t.Fatalf("alice got %v (closed %v) on room deletion", events, closed)
+	}
+}
+
+func TestHubDropsUnknownFrames(t *testing.T) {
+	h := NewHub(bus.NewLocal())
+	alice := testClient(h, "r1", "alice")
+	h.deliver("r1", []byte(`x{"type":"message"}`))
+	h.deliver("r1", []byte("u\x00{}"))
+	if events, closed := received(t, alice); len(events) != 0 || closed {
+		t.Fatalf("alice got %v (closed %v) from invalid frames", events, closed)
+	}
+}